@@ -0,0 +1,35 @@
+package client
+
+import (
+	"context"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+// BindConn is returned by dials of protocol.NetworkBind. The server listens
+// on BoundAddr, and the connection carries the data of the first inbound
+// connection once AcceptPeer returns.
+type BindConn struct {
+	*connectionWrapper
+}
+
+// BoundAddr returns the address the server listens on.
+func (c *BindConn) BoundAddr() string {
+	return c.response().Addr
+}
+
+// AcceptPeer waits for the inbound connection and returns its address.
+func (c *BindConn) AcceptPeer(ctx context.Context) (string, error) {
+	resp, err := protocol.ReadResponse(ctx, c.Conn)
+	if err == nil {
+		err = resp.Error()
+	}
+
+	if err != nil {
+		c.logger.WithError(err).Warn("error while waiting for inbound connection")
+		return "", err
+	}
+
+	c.logger.WithField("peer", resp.Addr).Debug("inbound connection accepted")
+	return resp.Addr, nil
+}
@@ -1,19 +1,72 @@
 package client
 
 import (
+	"fmt"
+	"net/url"
 	"os"
 	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+const (
+	TransportHTTP2 = "h2"
+	TransportPoll  = "poll"
 )
 
 type Config struct {
-	Address                string        `yaml:"address"`
-	DNSOverride            string        `yaml:"dns_override"`
-	RemoteTimeout          time.Duration `yaml:"remote_timeout"`
-	ConnectTimeout         time.Duration `yaml:"connect_timeout"`
-	KeepAliveTimeout       time.Duration `yaml:"keep_alive_timeout"`
-	MaxConnectionMultiplex int           `yaml:"max_connection_multiplex"`
+	Address        string        `yaml:"address"`
+	Transport      string        `yaml:"transport"`
+	Key            string        `yaml:"key"`
+	AuthCookie     string        `yaml:"auth_cookie"`
+	AuthHeader     string        `yaml:"auth_header"`
+	ClientCert     string        `yaml:"client_cert"`
+	ClientKey      string        `yaml:"client_key"`
+	CAFile         string        `yaml:"ca_file"`
+	PinnedKeys     []string      `yaml:"pinned_keys"`
+	PinnedCerts    []string      `yaml:"pinned_certs"`
+	TLSFingerprint string        `yaml:"tls_fingerprint"`
+	Request        RequestConfig `yaml:"request"`
+
+	Obfuscation            *protocol.ObfuscationParams `yaml:"obfuscation"`
+	DisableFallback        bool                        `yaml:"disable_fallback"`
+	DNSOverride            string                      `yaml:"dns_override"`
+	DialAddress            string                      `yaml:"dial_address"`
+	SNI                    string                      `yaml:"sni"`
+	HostHeader             string                      `yaml:"host_header"`
+	Path                   string                      `yaml:"path"`
+	RemoteTimeout          time.Duration               `yaml:"remote_timeout"`
+	ConnectTimeout         time.Duration               `yaml:"connect_timeout"`
+	KeepAliveTimeout       time.Duration               `yaml:"keep_alive_timeout"`
+	MaxConnectionMultiplex int                         `yaml:"max_connection_multiplex"`
+
+	Noise *NoiseConfig `yaml:"noise"`
+
+	ProxyUsers []ProxyUser `yaml:"proxy_users"`
+}
+
+// ProxyUser is a user of the local proxy. Connections of the user may be
+// routed differently from the others.
+type ProxyUser struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+
+	// DirectDial overrides the regexp for addresses dialed without the tunnel.
+	DirectDial string `yaml:"direct_dial"`
+
+	// Upstream is the config of a separate server for the user's connections.
+	// Timeouts and the multiplexing limit it leaves unset are taken from the
+	// main config.
+	Upstream *Config `yaml:"upstream"`
+}
+
+// NoiseConfig enables end-to-end encryption under the multiplexer, so that
+// anything terminating TLS in between sees only ciphertext.
+type NoiseConfig struct {
+	PrivateKey      string `yaml:"private_key"`
+	ServerPublicKey string `yaml:"server_public_key"`
 }
 
 func NewConfigFromFile(filename string) (*Config, error) {
@@ -28,5 +81,73 @@ func NewConfigFromFile(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.setupProxyUsers(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
+
+func (c *Config) validate() error {
+	u, err := url.Parse(c.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+
+	if _, ok := defaultPorts[u.Scheme]; !ok || u.Host == "" {
+		return fmt.Errorf("address %#v is not an http(s) or ws(s) url", c.Address)
+	}
+
+	switch c.Transport {
+	case "", TransportHTTP2, TransportPoll:
+	default:
+		return fmt.Errorf("unknown transport %#v", c.Transport)
+	}
+
+	return nil
+}
+
+// setupProxyUsers checks the proxy users and completes their upstream
+// configs with the settings of c.
+func (c *Config) setupProxyUsers() error {
+	names := make(map[string]bool)
+	for _, u := range c.ProxyUsers {
+		if u.Name == "" {
+			return fmt.Errorf("proxy user without name")
+		}
+
+		if names[u.Name] {
+			return fmt.Errorf("duplicate proxy user %#v", u.Name)
+		}
+		names[u.Name] = true
+
+		up := u.Upstream
+		if up == nil {
+			continue
+		}
+
+		if err := up.validate(); err != nil {
+			return fmt.Errorf("upstream of proxy user %#v: %v", u.Name, err)
+		}
+
+		if len(up.ProxyUsers) != 0 {
+			return fmt.Errorf("upstream of proxy user %#v: proxy users are set on the main config only", u.Name)
+		}
+
+		if up.ConnectTimeout == 0 {
+			up.ConnectTimeout = c.ConnectTimeout
+		}
+		if up.KeepAliveTimeout == 0 {
+			up.KeepAliveTimeout = c.KeepAliveTimeout
+		}
+		if up.MaxConnectionMultiplex == 0 {
+			up.MaxConnectionMultiplex = c.MaxConnectionMultiplex
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewConfigFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_ = f.Close()
+
+	load := func(config string) (*Config, error) {
+		if err := ioutil.WriteFile(f.Name(), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return NewConfigFromFile(f.Name())
+	}
+
+	cfg, err := load(`
+address: https://example.com/establish
+connect_timeout: 5s
+keep_alive_timeout: 30s
+max_connection_multiplex: 10
+proxy_users:
+  - name: alice
+    password: a
+  - name: bob
+    password: b
+    upstream:
+      address: wss://other.example.com/establish
+      transport: h2
+      keep_alive_timeout: 1m
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := cfg.ProxyUsers[1].Upstream
+	if up.ConnectTimeout != 5*time.Second || up.KeepAliveTimeout != time.Minute || up.MaxConnectionMultiplex != 10 {
+		t.Errorf("upstream settings: connect timeout %v, keep-alive timeout %v, multiplex %v",
+			up.ConnectTimeout, up.KeepAliveTimeout, up.MaxConnectionMultiplex)
+	}
+
+	invalid := []string{
+		`address: example.com`,
+		`address: ftp://example.com/`,
+		"address: https://example.com/\ntransport: quic",
+		"address: https://example.com/\nproxy_users: [{password: a}]",
+		"address: https://example.com/\nproxy_users: [{name: a}, {name: a}]",
+		"address: https://example.com/\nproxy_users: [{name: a, upstream: {}}]",
+		"address: https://example.com/\nproxy_users: [{name: a, upstream: {address: 'https://other/', transport: ws}}]",
+		"address: https://example.com/\nproxy_users: [{name: a, upstream: {address: 'https://other/', proxy_users: [{name: b}]}}]",
+	}
+
+	for _, config := range invalid {
+		if _, err := load(config); err == nil {
+			t.Errorf("config %q loaded", config)
+		}
+	}
+}
@@ -16,13 +16,24 @@ type connectionWrapper struct {
 	responseOnce   sync.Once
 	disconnectOnce sync.Once
 	onDisconnect   func()
-	logger         *log.Entry
+	// onResponseError is called if the response couldn't be read at all.
+	onResponseError func()
+	// checkResponse validates the successful response of the session.
+	checkResponse func(*protocol.ConnectionResponse) error
+	logger        *log.Entry
+	err           error
+
+	m    sync.Mutex
+	resp *protocol.ConnectionResponse
 
 	net.Conn
 }
 
 func (cw *connectionWrapper) Read(b []byte) (n int, err error) {
 	cw.responseOnce.Do(cw.ensureResponse)
+	if cw.err != nil {
+		return 0, cw.err
+	}
 	return cw.Conn.Read(b)
 }
 
@@ -40,19 +51,53 @@ func (cw *connectionWrapper) Close() (err error) {
 }
 
 func (cw *connectionWrapper) ensureResponse() {
+	cw.readResponse(context.TODO())
+}
+
+func (cw *connectionWrapper) readResponse(ctx context.Context) {
 	cw.logger.Trace("reading initial response")
-	resp, err := protocol.ReadResponse(context.TODO(), cw.Conn)
-	if err != nil || resp.Err != nil {
-		if err != nil {
-			cw.logger.WithError(err).Warn("error while dialing")
-		} else {
+	resp, err := protocol.ReadResponse(ctx, cw.Conn)
+	if err == nil {
+		err = resp.Error()
+	}
+
+	// A response that was read but failed the check is not a transport
+	// failure, so it doesn't trigger the fallback.
+	rejected := false
+	if err == nil && cw.checkResponse != nil {
+		err = cw.checkResponse(resp)
+		rejected = err != nil
+	}
+
+	if err != nil {
+		err = requestErrorCause(err)
+		if _, ok := err.(*PinMismatchError); ok {
+			logHandshakeError(cw.logger, err)
+		} else if _, ok := err.(*protocol.RemoteError); ok || rejected {
 			cw.logger.WithError(err).Error("error while dialing")
+		} else {
+			cw.logger.WithError(err).Warn("error while dialing")
+			if cw.onResponseError != nil {
+				cw.onResponseError()
+			}
 		}
 
+		cw.err = err
 		_ = cw.Conn.Close()
 		_, _ = io.Copy(ioutil.Discard, cw.Conn)
 		return
 	}
 
+	cw.m.Lock()
+	cw.resp = resp
+	cw.m.Unlock()
+
 	cw.logger.Debug("remote end connected")
 }
+
+// response returns the initial response if it has already been received.
+func (cw *connectionWrapper) response() *protocol.ConnectionResponse {
+	cw.m.Lock()
+	defer cw.m.Unlock()
+	return cw.resp
+}
@@ -1,16 +1,44 @@
 package client
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+
+	"github.com/neex/tcp-over-http/protocol"
+	"github.com/neex/tcp-over-http/transport"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+const (
+	// fallbackPeriod is how long the polling transport is used after the
+	// configured one failed, before the configured one is tried again.
+	fallbackPeriod     = 10 * time.Minute
+	pollRequestTimeout = time.Minute
 )
 
 type Connector struct {
 	Config *Config
+
+	m             sync.Mutex
+	fallbackUntil time.Time
 }
 
 func (c *Connector) Connect(logger *log.Entry) (*MultiplexedConnection, error) {
@@ -19,16 +47,96 @@ func (c *Connector) Connect(logger *log.Entry) (*MultiplexedConnection, error) {
 		return nil, err
 	}
 
-	host := c.Config.DNSOverride
+	var conn net.Conn
+	usePoll := c.Config.Transport == TransportPoll || c.inFallback()
+	if !usePoll {
+		conn, err = c.connectDirect(parsed, logger)
+		if err != nil {
+			if !c.inFallback() {
+				return nil, err
+			}
+			usePoll = true
+		}
+	}
+
+	if usePoll {
+		conn, err = c.connectPoll(parsed, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The server speaks first. Servers negotiating features offer them in
+	// the initial response, older ones send it without a hello and start
+	// the multiplexer right away.
+	offer := &connectionWrapper{
+		Conn:   conn,
+		logger: logger,
+	}
+
+	if !usePoll {
+		offer.onResponseError = func() { c.startFallback(logger) }
+	}
 
-	if host == "" {
-		host = parsed.Host
+	offer.responseOnce.Do(offer.ensureResponse)
+	if offer.err != nil {
+		return nil, offer.err
+	}
+
+	connCfg := &MultiplexedConnectionConfig{
+		MaxMultiplexedConnections: c.Config.MaxConnectionMultiplex,
+		RemoteDialTimeout:         c.Config.ConnectTimeout,
+		KeepAliveTimeout:          c.Config.KeepAliveTimeout,
+		Logger:                    logger,
+	}
 
-		if _, _, err := net.SplitHostPort(host); err != nil {
-			host = net.JoinHostPort(host, parsed.Scheme)
+	if offer.response().Hello == nil {
+		if err := c.checkHello(offer.response()); err != nil {
+			_ = conn.Close()
+			logger.WithError(err).Error("server doesn't negotiate features")
+			return nil, err
 		}
+
+		logger.Debug("server doesn't negotiate features")
+		connCfg.InitialResponse = offer.response
+		return NewMultiplexedConnection(conn, connCfg)
 	}
 
+	// The hello goes before the layers it turns on.
+	hello := protocol.NewClientHello(protocol.SupportedFeatures)
+	hello.Obfuscation = c.Config.Obfuscation
+	hello.Noise = c.Config.Noise != nil
+	if err := protocol.WritePacket(context.TODO(), conn, hello); err != nil {
+		_ = conn.Close()
+		logger.WithError(err).Error("error while sending hello")
+		return nil, err
+	}
+
+	cw := &connectionWrapper{
+		Conn:          conn,
+		logger:        logger,
+		checkResponse: c.checkHello,
+	}
+
+	var tunnel net.Conn = cw
+	if c.Config.Obfuscation != nil {
+		tunnel = transport.NewObfsConn(tunnel, *c.Config.Obfuscation)
+	}
+
+	if c.Config.Noise != nil {
+		tunnel, err = newNoiseConn(tunnel, c.Config.Noise)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	connCfg.InitialResponse = cw.response
+	return NewMultiplexedConnection(tunnel, connCfg)
+}
+
+func (c *Connector) connectDirect(parsed *url.URL, logger *log.Entry) (net.Conn, error) {
+	host := c.dialAddress(parsed)
 	d := &net.Dialer{
 		Timeout: c.Config.ConnectTimeout,
 	}
@@ -39,39 +147,458 @@ func (c *Connector) Connect(logger *log.Entry) (*MultiplexedConnection, error) {
 		return nil, err
 	}
 
-	if parsed.Scheme == "https" {
-		conn = tls.Client(conn, &tls.Config{
-			NextProtos: []string{"http/1.1"},
-			ServerName: parsed.Host,
-		})
+	isHTTP2 := c.Config.Transport == TransportHTTP2
+	isWebSocket := parsed.Scheme == "ws" || parsed.Scheme == "wss"
+	if parsed.Scheme == "https" || parsed.Scheme == "wss" {
+		nextProtos := []string{"http/1.1"}
+		if isHTTP2 {
+			nextProtos = []string{"h2", "http/1.1"}
+		}
+
+		conn, err = c.clientHandshake(conn, c.serverName(parsed), nextProtos)
+		if err != nil {
+			logHandshakeError(logger, err)
+			return nil, err
+		}
+
+		// A fingerprinted ClientHello offers h2 whatever the transport.
+		// Neither a plain request nor a websocket can run over it, so
+		// the tunnel goes over an http/2 stream instead.
+		if !isHTTP2 && negotiatedProtocol(conn) == "h2" {
+			logger.Debug("server negotiated h2, tunneling over http/2 stream")
+			isHTTP2 = true
+			isWebSocket = false
+		}
+	} else if isHTTP2 {
+		_ = conn.Close()
+		return nil, errors.New("h2 transport requires https")
 	}
 
-	req, err := http.NewRequest("GET", c.Config.Address, nil)
+	reqURL, err := c.requestURL(parsed)
 	if err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
 
-	req.Header.Set("user-agent", "")
-	if err := req.Write(conn); err != nil {
+	method := c.Config.Request.Method
+	switch {
+	case isWebSocket:
+		method = "GET"
+	case method == "" && isHTTP2:
+		method = "POST"
+	case method == "":
+		method = "GET"
+	}
+
+	req, err := http.NewRequest(method, reqURL.String(), nil)
+	if err != nil {
 		_ = conn.Close()
-		logger.WithError(err).Error("error while writing initial http request")
 		return nil, err
 	}
 
-	logger.Debug("lazy upstream connect successful")
+	req.Header = c.requestHeader()
+	if c.Config.HostHeader != "" {
+		req.Host = c.Config.HostHeader
+	}
 
-	cw := &connectionWrapper{
-		Conn:   conn,
-		logger: logger,
+	warmUps, err := c.warmUpRequests(reqURL)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
 	}
 
-	connCfg := &MultiplexedConnectionConfig{
-		MaxMultiplexedConnections: c.Config.MaxConnectionMultiplex,
-		RemoteDialTimeout:         c.Config.ConnectTimeout,
-		KeepAliveTimeout:          c.Config.KeepAliveTimeout,
-		Logger:                    logger,
+	order := c.Config.Request.headerOrder()
+	if !isHTTP2 && len(warmUps) > 0 {
+		warmConn, err := warmUpHTTP1(conn, warmUps, order)
+		if err != nil {
+			_ = conn.Close()
+			logger.WithError(err).Error("error while fetching warm-up pages")
+			return nil, err
+		}
+
+		logger.WithField("pages", len(warmUps)).Debug("warm-up pages fetched")
+		conn = warmConn
+	}
+
+	if isHTTP2 {
+		conn, err = establishHTTP2(conn, req, warmUps)
+		if err != nil {
+			_ = conn.Close()
+			logger.WithError(err).Error("error while establishing http/2 stream")
+			c.startFallback(logger)
+			return nil, err
+		}
+
+		logger.Debug("http/2 stream established")
+	} else if isWebSocket {
+		conn, err = establishWebSocket(conn, req, order)
+		if err != nil {
+			_ = conn.Close()
+			logger.WithError(err).Error("error while establishing websocket")
+			c.startFallback(logger)
+			return nil, err
+		}
+
+		logger.Debug("websocket established")
+	} else {
+		if err := writeRequest(conn, req, order); err != nil {
+			_ = conn.Close()
+			logger.WithError(err).Error("error while writing initial http request")
+			return nil, err
+		}
+
+		logger.Debug("lazy upstream connect successful")
+	}
+
+	return conn, nil
+}
+
+// connectPoll starts a polling session, which works through any HTTP proxy
+// (taken from the environment) at the cost of latency.
+func (c *Connector) connectPoll(parsed *url.URL, logger *log.Entry) (net.Conn, error) {
+	u, err := c.requestURL(parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+
+	target := hostPort(u)
+	dialAddress := c.dialAddress(u)
+	serverName := c.serverName(u)
+
+	tlsConfig, err := c.tlsConfig(serverName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{
+		Timeout: c.Config.ConnectTimeout,
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == target {
+			addr = dialAddress
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dial,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: c.Config.ConnectTimeout,
+	}
+
+	var rt http.RoundTripper = tr
+	if c.Config.TLSFingerprint != "" && u.Scheme == "https" {
+		tr.DialTLS = func(network, addr string) (net.Conn, error) {
+			conn, err := dial(context.Background(), network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			name := serverName
+			if addr != target {
+				name, _, _ = net.SplitHostPort(addr)
+			}
+			return c.clientHandshake(conn, name, nil)
+		}
+		rt = newFingerprintTransport(tr)
+	}
+
+	logger.Info("starting polling session")
+	if c.Config.HostHeader != "" {
+		rt = &hostOverride{host: c.Config.HostHeader, next: rt}
+	}
+
+	client := &http.Client{Transport: rt, Timeout: pollRequestTimeout}
+
+	warmUps, err := c.warmUpRequests(u)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, req := range warmUps {
+		resp, err := client.Do(req)
+		if err != nil {
+			err = requestErrorCause(err)
+			if _, ok := err.(*PinMismatchError); ok {
+				logHandshakeError(logger, err)
+			} else {
+				logger.WithError(err).Error("error while fetching warm-up pages")
+			}
+			return nil, err
+		}
+		_ = discardBody(resp)
+	}
+	return transport.NewPollClientConn(client, u.String(), c.requestHeader)
+}
+
+// dialAddress is where the TCP connection goes. With domain fronting, it is
+// the CDN edge rather than the host from the address.
+func (c *Connector) dialAddress(u *url.URL) string {
+	if c.Config.DialAddress != "" {
+		return c.Config.DialAddress
 	}
 
-	return NewMultiplexedConnection(cw, connCfg)
+	if c.Config.DNSOverride != "" {
+		return c.Config.DNSOverride
+	}
+
+	return hostPort(u)
+}
+
+func (c *Connector) serverName(u *url.URL) string {
+	if c.Config.SNI != "" {
+		return c.Config.SNI
+	}
+	return u.Hostname()
+}
+
+func (c *Connector) requestURL(u *url.URL) (*url.URL, error) {
+	if c.Config.Path == "" {
+		r := *u
+		return &r, nil
+	}
+
+	ref, err := url.Parse(c.Config.Path)
+	if err != nil {
+		return nil, err
+	}
+	return u.ResolveReference(ref), nil
+}
+
+func hostPort(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Host, defaultPorts[u.Scheme])
+}
+
+// clientHandshake does the TLS handshake on conn, with the browser-like
+// ClientHello if configured. On error, conn is closed.
+func (c *Connector) clientHandshake(conn net.Conn, serverName string, nextProtos []string) (net.Conn, error) {
+	tlsConfig, err := c.tlsConfig(serverName, nextProtos)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	var tlsConn interface {
+		net.Conn
+		Handshake() error
+	}
+
+	if c.Config.TLSFingerprint != "" {
+		tlsConn, err = fingerprintedClient(conn, tlsConfig, c.Config.TLSFingerprint)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	} else {
+		tlsConn = tls.Client(conn, tlsConfig)
+	}
+
+	if c.Config.ConnectTimeout != 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.Config.ConnectTimeout))
+	}
+	err = tlsConn.Handshake()
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func (c *Connector) tlsConfig(serverName string, nextProtos []string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		NextProtos: nextProtos,
+		ServerName: serverName,
+	}
+
+	if c.Config.CAFile != "" {
+		pool, err := loadCAFile(c.Config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(c.Config.PinnedKeys) > 0 || len(c.Config.PinnedCerts) > 0 {
+		verify, err := pinVerifier(serverName, cfg.RootCAs, c.Config.PinnedKeys, c.Config.PinnedCerts)
+		if err != nil {
+			return nil, err
+		}
+
+		// The pins are checked instead of the chain.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verify
+	}
+
+	if c.Config.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Config.ClientCert, c.Config.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+func (c *Connector) requestHeader() http.Header {
+	var token string
+	var cookies []*http.Cookie
+	if c.Config.Key != "" {
+		token = protocol.NewAuthToken(c.Config.Key, time.Now())
+		if c.Config.AuthHeader == "" {
+			name := c.Config.AuthCookie
+			if name == "" {
+				name = protocol.DefaultAuthCookie
+			}
+			cookies = append(cookies, &http.Cookie{Name: name, Value: token})
+		}
+	}
+
+	h := c.Config.Request.baseHeader(cookies...)
+	if token != "" && c.Config.AuthHeader != "" {
+		h.Set(c.Config.AuthHeader, token)
+	}
+
+	return h
+}
+
+// checkHello makes sure the server has turned on the layers the client uses,
+// otherwise it can't understand anything the client sends.
+func (c *Connector) checkHello(resp *protocol.ConnectionResponse) error {
+	if c.Config.Obfuscation != nil && (resp.Hello == nil || resp.Hello.Obfuscation == nil) {
+		return errors.New("server doesn't support obfuscation")
+	}
+
+	if c.Config.Noise != nil && (resp.Hello == nil || !resp.Hello.Noise) {
+		return errors.New("server doesn't support noise encryption or has no key for the user")
+	}
+
+	return nil
+}
+
+func newNoiseConn(conn net.Conn, cfg *NoiseConfig) (net.Conn, error) {
+	key, err := transport.NoiseKeyFromPrivate(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	serverKey, err := transport.DecodeNoisePublicKey(cfg.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return transport.NewNoiseConn(conn, key, serverKey)
+}
+
+func (c *Connector) inFallback() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return time.Now().Before(c.fallbackUntil)
+}
+
+func (c *Connector) startFallback(logger *log.Entry) {
+	if c.Config.DisableFallback || c.Config.Transport == TransportPoll {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if time.Now().Before(c.fallbackUntil) {
+		return
+	}
+
+	logger.Warn("transport failed, falling back to polling")
+	c.fallbackUntil = time.Now().Add(fallbackPeriod)
+}
+
+// establishWebSocket does the websocket handshake. Unlike the raw transport,
+// it has to wait for the server response before sending anything else.
+func establishWebSocket(conn net.Conn, req *http.Request, order []string) (net.Conn, error) {
+	key := transport.NewWebSocketKey()
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := writeRequest(conn, req, order); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+
+	if err := transport.CheckWebSocketResponse(resp, key); err != nil {
+		return conn, err
+	}
+
+	return transport.NewWebSocketConn(conn, br, true), nil
+}
+
+// establishHTTP2 opens a long-lived HTTP/2 request whose request and response
+// bodies carry the tunnel. The warm-up requests are done before, on the same
+// connection.
+func establishHTTP2(conn net.Conn, req *http.Request, warmUps []*http.Request) (net.Conn, error) {
+	if proto := negotiatedProtocol(conn); proto != "h2" {
+		return conn, fmt.Errorf("server negotiated %#v instead of h2", proto)
+	}
+
+	t := &http2.Transport{}
+	cc, err := t.NewClientConn(conn)
+	if err != nil {
+		return conn, err
+	}
+
+	for _, warmUp := range warmUps {
+		resp, err := cc.RoundTrip(warmUp)
+		if err != nil {
+			return conn, err
+		}
+
+		if err := discardBody(resp); err != nil {
+			return conn, err
+		}
+	}
+
+	pr, pw := io.Pipe()
+	req.Body = pr
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		return conn, err
+	}
+
+	if resp.StatusCode != 200 {
+		_ = resp.Body.Close()
+		return conn, fmt.Errorf("unexpected http/2 response: %v", resp.Status)
+	}
+
+	return transport.NewStreamConn(resp.Body, pw, conn, func() { _ = conn.Close() }), nil
+}
+
+// hostOverride sets the Host header different from the host requests are
+// sent to.
+type hostOverride struct {
+	host string
+	next http.RoundTripper
+}
+
+func (h *hostOverride) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := *req
+	r.Host = h.host
+	return h.next.RoundTrip(&r)
 }
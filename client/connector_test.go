@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+// baselineRequest and baselineResponse are the packets of servers without
+// feature negotiation.
+type baselineRequest struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+type baselineResponse struct {
+	Err     *string
+	Padding string
+}
+
+func writeBaselinePacket(t *testing.T, to io.Writer, val interface{}) {
+	t.Helper()
+	data, err := json.Marshal(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(data)))
+	if _, err := to.Write(append(append([]byte("Elda"), l[:]...), data...)); err != nil {
+		t.Error(err)
+	}
+}
+
+func readBaselinePacket(t *testing.T, from io.Reader, val interface{}) {
+	t.Helper()
+	var header [8]byte
+	if _, err := io.ReadFull(from, header[:]); err != nil {
+		t.Error(err)
+		return
+	}
+	if string(header[:4]) != "Elda" {
+		t.Errorf("magic %q", header[:4])
+		return
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[4:]))
+	if _, err := io.ReadFull(from, data); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(val); err != nil {
+		t.Error(err)
+	}
+}
+
+// baselineServer does the handshake of servers without feature negotiation:
+// the initial response goes out right away and the multiplexer starts. Each
+// stream echoes what it gets.
+func baselineServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, br, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		writeBaselinePacket(t, conn, &baselineResponse{Padding: strings.Repeat("00", 500)})
+
+		sess, err := yamux.Server(&hijackedConn{Reader: br, Conn: conn}, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for {
+			stream, err := sess.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = stream.Close() }()
+
+				var req baselineRequest
+				readBaselinePacket(t, stream, &req)
+				if req.Network != "tcp" || req.Address != "echo.example.com:7" || req.Timeout <= 0 {
+					t.Errorf("unexpected request %+v", req)
+				}
+
+				writeBaselinePacket(t, stream, &baselineResponse{})
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}))
+}
+
+type hijackedConn struct {
+	io.Reader
+	net.Conn
+}
+
+func (hc *hijackedConn) Read(b []byte) (int, error) {
+	return hc.Reader.Read(b)
+}
+
+func TestConnectBaselineServer(t *testing.T) {
+	srv := baselineServer(t)
+	defer srv.Close()
+
+	c := &Connector{Config: &Config{
+		Address:         srv.URL + "/establish/token",
+		ConnectTimeout:  5 * time.Second,
+		DisableFallback: true,
+	}}
+
+	mc, err := c.Connect(log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := mc.DialContext(context.Background(), "tcp", "echo.example.com:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo: %q, %v", buf, err)
+		}
+		_ = conn.Close()
+	}
+
+	if mc.framing() != protocol.FramingJSON {
+		t.Error("binary framing is used with a server not supporting it")
+	}
+}
+
+func TestConnectBaselineServerLayers(t *testing.T) {
+	srv := baselineServer(t)
+	defer srv.Close()
+
+	c := &Connector{Config: &Config{
+		Address:         srv.URL + "/establish/token",
+		DisableFallback: true,
+		Obfuscation:     &protocol.ObfuscationParams{},
+	}}
+
+	if mc, err := c.Connect(log.NewEntry(log.StandardLogger())); err == nil {
+		mc.Close()
+		t.Fatal("obfuscation is turned on with a server not supporting it")
+	}
+}
+
+// TestConnectDirectFronting checks on the wire that the TCP connection, SNI,
+// Host header and path each follow their own setting.
+func TestConnectDirectFronting(t *testing.T) {
+	type seen struct{ sni, host, path, proto string }
+	requests := make(chan seen, 1)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{r.TLS.ServerName, r.Host, r.URL.Path, r.Proto}
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(ca.Name()) }()
+	_ = pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	_ = ca.Close()
+
+	for _, transport := range []string{"", TransportHTTP2} {
+		c := &Connector{Config: &Config{
+			// The host of the address doesn't resolve, the connection
+			// must go to the dial address.
+			Address:     "https://front.invalid/base/",
+			Transport:   transport,
+			CAFile:      ca.Name(),
+			DialAddress: srv.Listener.Addr().String(),
+			SNI:         "example.com",
+			HostHeader:  "backend.example.org",
+			Path:        "tunnel/establish",
+		}}
+
+		parsed, _ := url.Parse(c.Config.Address)
+		conn, err := c.connectDirect(parsed, log.NewEntry(log.StandardLogger()))
+		if err != nil {
+			t.Fatalf("transport %#v: %v", transport, err)
+		}
+
+		select {
+		case got := <-requests:
+			want := seen{"example.com", "backend.example.org", "/base/tunnel/establish", "HTTP/1.1"}
+			if transport == TransportHTTP2 {
+				want.proto = "HTTP/2.0"
+			}
+			if got != want {
+				t.Errorf("transport %#v: server saw %+v, want %+v", transport, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("transport %#v: no request arrived", transport)
+		}
+
+		_ = conn.Close()
+	}
+}
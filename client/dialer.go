@@ -78,9 +78,14 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		return c
 	}
 	if c := d.takeFromPool(); c != nil {
-		if conn, err := d.dialVia(ctx, c, network, address); err == nil {
+		conn, err := d.dialVia(ctx, c, network, address)
+		if err == nil {
 			return maybeWrap(conn), err
 		}
+
+		if _, ok := err.(*protocol.RemoteError); ok || ctx.Err() != nil {
+			return nil, err
+		}
 	}
 
 	mc, err := d.makeConn()
@@ -107,6 +112,15 @@ func (d *Dialer) Ping() (time.Duration, error) {
 
 func (d *Dialer) dialVia(ctx context.Context, c *MultiplexedConnection, network, address string) (net.Conn, error) {
 	conn, err := c.DialContext(ctx, network, address)
+	if _, ok := err.(*protocol.RemoteError); ok || (err != nil && ctx.Err() != nil) {
+		// The session itself is fine, only the remote dial failed or took
+		// longer than the caller wanted to wait; its stream is closed.
+		if c.IsDialable() {
+			d.putToPool(c)
+		}
+		return nil, err
+	}
+
 	if err != nil {
 		c.Close()
 		return nil, err
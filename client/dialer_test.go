@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+// silentServer accepts streams, reads the connection request and never
+// answers it. Closed streams are reported on the returned channel.
+func silentServer(t *testing.T, conn net.Conn) <-chan struct{} {
+	t.Helper()
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{}, 16)
+	go func() {
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := protocol.ReadRequest(context.Background(), stream); err != nil {
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, stream)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return closed
+}
+
+func TestDialerContextExpiryKeepsSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	closed := silentServer(t, c2)
+
+	mc, err := NewMultiplexedConnection(c1, &MultiplexedConnectionConfig{Logger: log.NewEntry(log.StandardLogger())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	d := &Dialer{connPool: []*MultiplexedConnection{mc}}
+	defer d.Close()
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		conn, err := d.DialContext(ctx, "tcp", "example.com:80")
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("dial %v: got conn %v, error %v, want %v", i, conn, err, context.DeadlineExceeded)
+		}
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("dial %v: stream isn't closed", i)
+		}
+
+		if !mc.IsDialable() {
+			t.Fatalf("dial %v: session is torn down", i)
+		}
+		if c := d.takeFromPool(); c != mc {
+			t.Fatalf("dial %v: session isn't returned to the pool", i)
+		} else {
+			d.putToPool(c)
+		}
+	}
+}
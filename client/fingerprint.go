@@ -0,0 +1,188 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// TLS ClientHello profiles. Safari and iOS share the TLS stack, so both use
+// the iOS profile.
+const (
+	FingerprintChrome     = "chrome"
+	FingerprintFirefox    = "firefox"
+	FingerprintSafari     = "safari"
+	FingerprintIOS        = "ios"
+	FingerprintRandomized = "randomized"
+)
+
+// fingerprints are pinned to the newest profiles of the utls version in use
+// rather than to its *_Auto aliases, so they don't change unnoticed with an
+// update. These are Chrome 83, Firefox 65 and iOS 12.1, which are out of date
+// by now: a censor matching on exact browser versions sees an old browser.
+var fingerprints = map[string]utls.ClientHelloID{
+	FingerprintChrome:     utls.HelloChrome_83,
+	FingerprintFirefox:    utls.HelloFirefox_65,
+	FingerprintSafari:     utls.HelloIOS_12_1,
+	FingerprintIOS:        utls.HelloIOS_12_1,
+	FingerprintRandomized: utls.HelloRandomizedALPN,
+}
+
+// fingerprintedClient makes a TLS client sending a ClientHello mimicking a
+// browser. The ALPN list of the profile is kept as is, since a browser never
+// offers http/1.1 alone, so the server may pick h2 whatever the transport;
+// callers check negotiatedProtocol.
+func fingerprintedClient(conn net.Conn, cfg *tls.Config, fingerprint string) (*utls.UConn, error) {
+	id, ok := fingerprints[fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls fingerprint %#v", fingerprint)
+	}
+
+	ucfg := &utls.Config{
+		ServerName:            cfg.ServerName,
+		RootCAs:               cfg.RootCAs,
+		InsecureSkipVerify:    cfg.InsecureSkipVerify,
+		VerifyPeerCertificate: cfg.VerifyPeerCertificate,
+	}
+
+	for _, cert := range cfg.Certificates {
+		ucfg.Certificates = append(ucfg.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			OCSPStaple:  cert.OCSPStaple,
+			Leaf:        cert.Leaf,
+		})
+	}
+
+	uconn := utls.UClient(conn, ucfg, id)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+
+	return uconn, nil
+}
+
+func negotiatedProtocol(conn net.Conn) string {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().NegotiatedProtocol
+	case *utls.UConn:
+		return c.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
+
+// fingerprintTransport carries the requests of a polling session over
+// connections with a fingerprinted ClientHello. The server may pick h2 on
+// them, which http.Transport only notices on *tls.Conn, so the connections
+// are dialed here and handed to an HTTP/2 or HTTP/1.1 transport depending on
+// the negotiated protocol. Proxied requests go to the HTTP/1.1 transport,
+// which does the handshake with the standard library.
+type fingerprintTransport struct {
+	dialTLS func(network, addr string) (net.Conn, error)
+	h1      *http.Transport
+	h2      *http2.Transport
+
+	m       sync.Mutex
+	h2Conns map[string]*http2.ClientConn
+	isHTTP1 map[string]bool
+	spare   map[string]net.Conn
+}
+
+// newFingerprintTransport takes over the DialTLS function of h1.
+func newFingerprintTransport(h1 *http.Transport) *fingerprintTransport {
+	t := &fingerprintTransport{
+		dialTLS: h1.DialTLS,
+		h1:      h1,
+		h2:      &http2.Transport{},
+		h2Conns: make(map[string]*http2.ClientConn),
+		isHTTP1: make(map[string]bool),
+		spare:   make(map[string]net.Conn),
+	}
+	h1.DialTLS = t.dialHTTP1
+	return t
+}
+
+func (t *fingerprintTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.h1.RoundTrip(req)
+	}
+
+	if t.h1.Proxy != nil {
+		if proxy, err := t.h1.Proxy(req); err != nil || proxy != nil {
+			return t.h1.RoundTrip(req)
+		}
+	}
+
+	addr := hostPort(req.URL)
+	cc, err := t.h2Conn(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc == nil {
+		return t.h1.RoundTrip(req)
+	}
+	return cc.RoundTrip(req)
+}
+
+// h2Conn returns the HTTP/2 connection to addr, or nil if the server speaks
+// HTTP/1.1 only.
+func (t *fingerprintTransport) h2Conn(addr string) (*http2.ClientConn, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.isHTTP1[addr] {
+		return nil, nil
+	}
+
+	if cc := t.h2Conns[addr]; cc != nil && cc.CanTakeNewRequest() {
+		return cc, nil
+	}
+
+	conn, err := t.dialTLS("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if negotiatedProtocol(conn) != "h2" {
+		t.isHTTP1[addr] = true
+		t.spare[addr] = conn
+		return nil, nil
+	}
+
+	cc, err := t.h2.NewClientConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	t.h2Conns[addr] = cc
+	return cc, nil
+}
+
+// dialHTTP1 hands the connection dialed to find out the protocol to the
+// HTTP/1.1 transport.
+func (t *fingerprintTransport) dialHTTP1(network, addr string) (net.Conn, error) {
+	t.m.Lock()
+	conn := t.spare[addr]
+	delete(t.spare, addr)
+	t.m.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := t.dialTLS(network, addr)
+	if err == nil && negotiatedProtocol(conn) == "h2" {
+		_ = conn.Close()
+		return nil, errors.New("server switched to h2")
+	}
+	return conn, err
+}
@@ -0,0 +1,333 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// grease stands for any GREASE value in the expected lists.
+const grease = 0x0a0a
+
+const extensionPadding = 21
+
+type clientHello struct {
+	cipherSuites []uint16
+	extensions   []uint16
+	alpn         []string
+	serverName   string
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// captureClientHello makes a handshake with the fingerprint against a local
+// listener and returns the parsed ClientHello.
+func captureClientHello(t *testing.T, fingerprint string) *clientHello {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = lsn.Close() }()
+
+	go func() {
+		conn, err := net.Dial("tcp", lsn.Addr().String())
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		uconn, err := fingerprintedClient(conn, &tls.Config{ServerName: "example.com"}, fingerprint)
+		if err != nil {
+			return
+		}
+		_ = uconn.Handshake()
+	}()
+
+	conn, err := lsn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var header [5]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 22 {
+		t.Fatalf("record type %v instead of handshake", header[0])
+	}
+
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(conn, record); err != nil {
+		t.Fatal(err)
+	}
+
+	hello, err := parseClientHello(record)
+	if err != nil {
+		t.Fatalf("%v: %x", err, record)
+	}
+	return hello
+}
+
+func parseClientHello(msg []byte) (*clientHello, error) {
+	errShort := errors.New("truncated client hello")
+	r := &helloReader{b: msg}
+
+	if r.byte() != 1 {
+		return nil, errors.New("not a client hello")
+	}
+	body := r.bytes(r.int(3))
+	if r.err {
+		return nil, errShort
+	}
+
+	r = &helloReader{b: body}
+	r.bytes(2 + 32) // version, random
+	r.bytes(r.int(1))
+
+	hello := &clientHello{}
+	suites := &helloReader{b: r.bytes(r.int(2))}
+	for len(suites.b) > 0 && !suites.err {
+		hello.cipherSuites = append(hello.cipherSuites, uint16(suites.int(2)))
+	}
+	r.bytes(r.int(1)) // compression methods
+
+	exts := &helloReader{b: r.bytes(r.int(2))}
+	for len(exts.b) > 0 && !exts.err {
+		typ := uint16(exts.int(2))
+		data := &helloReader{b: exts.bytes(exts.int(2))}
+		hello.extensions = append(hello.extensions, typ)
+
+		switch typ {
+		case 0:
+			data.bytes(2 + 1)
+			hello.serverName = string(data.bytes(data.int(2)))
+		case 16:
+			list := &helloReader{b: data.bytes(data.int(2))}
+			for len(list.b) > 0 && !list.err {
+				hello.alpn = append(hello.alpn, string(list.bytes(list.int(1))))
+			}
+			data.err = data.err || list.err
+		}
+
+		if data.err {
+			return nil, fmt.Errorf("malformed extension %v", typ)
+		}
+	}
+
+	if r.err || suites.err || exts.err {
+		return nil, errShort
+	}
+	return hello, nil
+}
+
+type helloReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if n > len(r.b) {
+		r.err = true
+		n = len(r.b)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *helloReader) byte() byte {
+	b := r.bytes(1)
+	if len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *helloReader) int(n int) int {
+	v := 0
+	for _, b := range r.bytes(n) {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// normalize replaces GREASE values with the grease constant and drops the
+// padding, which depends on the length of the hello.
+func normalize(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		switch {
+		case isGREASE(v):
+			out = append(out, grease)
+		case v != extensionPadding:
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func TestFingerprintProfiles(t *testing.T) {
+	tests := []struct {
+		fingerprint  string
+		cipherSuites []uint16
+		extensions   []uint16
+		alpn         []string
+	}{
+		{
+			fingerprint: FingerprintChrome,
+			cipherSuites: []uint16{
+				grease, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+				0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+			},
+			extensions: []uint16{grease, 0, 23, 65281, 10, 11, 35, 16, 5, 13, 18, 51, 45, 43, 27, grease},
+			alpn:       []string{"h2", "http/1.1"},
+		},
+		{
+			fingerprint: FingerprintFirefox,
+			cipherSuites: []uint16{
+				0x1301, 0x1303, 0x1302, 0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc02c, 0xc030,
+				0xc00a, 0xc009, 0xc013, 0xc014, 0x0033, 0x0039, 0x002f, 0x0035, 0x000a,
+			},
+			extensions: []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 51, 43, 13, 45, 28},
+			alpn:       []string{"h2", "http/1.1"},
+		},
+		{
+			fingerprint: FingerprintSafari,
+			cipherSuites: []uint16{
+				0xc02c, 0xc02b, 0xc024, 0xc023, 0xc00a, 0xc009, 0xcca9, 0xc030, 0xc02f, 0xc028, 0xc027, 0xc014,
+				0xc013, 0xcca8, 0x009d, 0x009c, 0x003d, 0x003c, 0x0035, 0x002f, 0xc008, 0xc012, 0x000a,
+			},
+			extensions: []uint16{65281, 0, 23, 13, 5, 13172, 18, 16, 11, 10},
+			alpn:       []string{"h2", "h2-16", "h2-15", "h2-14", "spdy/3.1", "spdy/3", "http/1.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		hello := captureClientHello(t, tt.fingerprint)
+
+		if got := normalize(hello.cipherSuites); !reflect.DeepEqual(got, tt.cipherSuites) {
+			t.Errorf("%v: cipher suites %#04x, want %#04x", tt.fingerprint, got, tt.cipherSuites)
+		}
+
+		if got := normalize(hello.extensions); !reflect.DeepEqual(got, tt.extensions) {
+			t.Errorf("%v: extensions %v, want %v", tt.fingerprint, got, tt.extensions)
+		}
+
+		if !reflect.DeepEqual(hello.alpn, tt.alpn) {
+			t.Errorf("%v: alpn %v, want %v", tt.fingerprint, hello.alpn, tt.alpn)
+		}
+
+		if hello.serverName != "example.com" {
+			t.Errorf("%v: server name %#v", tt.fingerprint, hello.serverName)
+		}
+	}
+
+	if captureClientHello(t, FingerprintIOS).extensions[0] != 65281 {
+		t.Error("ios profile differs from safari")
+	}
+}
+
+func TestFingerprintGREASEIsRandom(t *testing.T) {
+	seen := make(map[uint16]bool)
+	for i := 0; i < 8; i++ {
+		seen[captureClientHello(t, FingerprintChrome).cipherSuites[0]] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("GREASE values don't change: %v", seen)
+	}
+}
+
+func TestFingerprintRandomized(t *testing.T) {
+	orders := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		hello := captureClientHello(t, FingerprintRandomized)
+
+		if !reflect.DeepEqual(hello.alpn, []string{"h2", "http/1.1"}) {
+			t.Errorf("alpn %v", hello.alpn)
+		}
+
+		if hello.serverName != "example.com" {
+			t.Errorf("server name %#v", hello.serverName)
+		}
+
+		orders[fmt.Sprint(normalize(hello.cipherSuites), normalize(hello.extensions))] = true
+	}
+
+	if len(orders) < 2 {
+		t.Error("randomized hellos are all the same")
+	}
+}
+
+func TestFingerprintUnknown(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close(); _ = server.Close() }()
+
+	if _, err := fingerprintedClient(client, &tls.Config{}, "netscape"); err == nil {
+		t.Error("no error for unknown fingerprint")
+	}
+}
+
+func TestFingerprintTransport(t *testing.T) {
+	for _, h2 := range []bool{true, false} {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.Proto)
+		}))
+		srv.EnableHTTP2 = h2
+		srv.StartTLS()
+
+		dials := 0
+		tr := &http.Transport{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				dials++
+				conn, err := net.Dial(network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				uconn, err := fingerprintedClient(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}, FingerprintChrome)
+				if err != nil {
+					return nil, err
+				}
+				return uconn, uconn.Handshake()
+			},
+		}
+
+		client := &http.Client{Transport: newFingerprintTransport(tr)}
+		want := "HTTP/1.1"
+		if h2 {
+			want = "HTTP/2.0"
+		}
+
+		for i := 0; i < 3; i++ {
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatalf("h2 %v: %v", h2, err)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if string(body) != want || resp.Proto != want {
+				t.Errorf("h2 %v: server saw %v, client %v", h2, string(body), resp.Proto)
+			}
+		}
+
+		if dials != 1 {
+			t.Errorf("h2 %v: %v connections dialed", h2, dials)
+		}
+
+		tr.CloseIdleConnections()
+		srv.Close()
+	}
+}
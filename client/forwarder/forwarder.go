@@ -45,22 +45,36 @@ func (f *Forwarder) ForwardConnection(ctx context.Context, r *ForwardRequest) er
 		r.OnConnected()
 	}
 
+	Relay(newCtx, r.ClientConn, upstream)
+	return nil
+}
+
+// Relay copies data between the connections until either side is done, then
+// closes both.
+func Relay(ctx context.Context, clientConn, upstream net.Conn) {
+	newCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-newCtx.Done()
+		_ = clientConn.Close()
+		_ = upstream.Close()
+	}()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer cancel()
-		packetCopy(upstream, r.ClientConn, 65536)
+		packetCopy(upstream, clientConn, 65536)
 	}()
 
 	go func() {
 		defer wg.Done()
 		defer cancel()
-		packetCopy(r.ClientConn, upstream, 65536)
+		packetCopy(clientConn, upstream, 65536)
 	}()
 
 	wg.Wait()
-	return nil
 }
 
 // packetCopy copies streams without quirks used by io.Copy. That is
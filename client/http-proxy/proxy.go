@@ -0,0 +1,355 @@
+package http_proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neex/tcp-over-http/client/forwarder"
+	socks5server "github.com/neex/tcp-over-http/client/socks5-server"
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+// hopHeaders are the headers of a single connection, which are not passed
+// on by proxies.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type HTTPProxy struct {
+	Forwarder *forwarder.Forwarder
+
+	// Authenticate, if set, makes the clients authenticate with Basic
+	// credentials in Proxy-Authorization. It returns the forwarder for the
+	// user's connections, or nil if the credentials are wrong.
+	Authenticate func(username, password string) *forwarder.Forwarder
+
+	// Socks, if set, serves the SOCKS clients connecting to the same port.
+	// They are told apart by the first byte.
+	Socks *socks5server.Socks5Server
+
+	m          sync.Mutex
+	transports map[*forwarder.Forwarder]*http.Transport
+}
+
+func (p *HTTPProxy) ListenAndServe(ctx context.Context, addr string) error {
+	newCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lc := &net.ListenConfig{}
+	lsn, err := lc.Listen(newCtx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-newCtx.Done()
+		_ = lsn.Close()
+	}()
+
+	log.Info("http proxy started")
+
+	for {
+		conn, err := lsn.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			l := log.WithField("remote_addr", conn.RemoteAddr())
+			err := p.ServeConn(newCtx, conn)
+			if err != nil {
+				l.WithError(err).Warn("proxy client handle error")
+			} else {
+				l.Debug("proxy client handling finished")
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single client connection.
+func (p *HTTPProxy) ServeConn(ctx context.Context, conn net.Conn) error {
+	newCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-newCtx.Done()
+		_ = conn.Close()
+	}()
+
+	br := bufio.NewReader(conn)
+	if p.Socks != nil {
+		first, err := br.Peek(1)
+		if err != nil {
+			return fmt.Errorf("read short during first msg, %v", err)
+		}
+
+		if first[0] == 4 || first[0] == 5 {
+			return p.Socks.ServeConn(newCtx, &bufferedConn{r: br, Conn: conn})
+		}
+	}
+
+	logger := log.WithField("remote_addr", conn.RemoteAddr())
+	for {
+		req, err := http.ReadRequest(br)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		f := p.authorize(req, logger)
+		if f == nil {
+			_, _ = io.Copy(ioutil.Discard, req.Body)
+			resp := errorResponse(req, http.StatusProxyAuthRequired, "proxy authentication required")
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			if err := resp.Write(conn); err != nil || req.Close {
+				return err
+			}
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			return p.handleConnect(newCtx, f, &bufferedConn{r: br, Conn: conn}, req)
+		}
+
+		keepAlive, err := p.handleRequest(newCtx, f, conn, req, logger)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+func (p *HTTPProxy) authorize(req *http.Request, logger *log.Entry) *forwarder.Forwarder {
+	if p.Authenticate == nil {
+		return p.Forwarder
+	}
+
+	username, password, ok := proxyCredentials(req)
+	if !ok {
+		logger.Debug("http proxy request without credentials")
+		return nil
+	}
+
+	f := p.Authenticate(username, password)
+	if f == nil {
+		logger.WithField("username", username).Warn("http proxy authentication failed")
+	}
+	return f
+}
+
+func (p *HTTPProxy) handleConnect(ctx context.Context, f *forwarder.Forwarder, conn net.Conn, req *http.Request) error {
+	address := req.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		_ = errorResponse(req, http.StatusBadRequest, "invalid address").Write(conn)
+		return fmt.Errorf("invalid connect address %#v", address)
+	}
+
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, f.DialTimeout)
+	upstream, err := f.Dial(dialCtx, "tcp", address)
+	dialCtxCancel()
+	if err != nil {
+		_ = errorResponse(req, gatewayStatus(err), err.Error()).Write(conn)
+		return fmt.Errorf("dial failed, %v", err)
+	}
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		_ = upstream.Close()
+		return err
+	}
+
+	forwarder.Relay(ctx, conn, upstream)
+	return nil
+}
+
+// handleRequest forwards a request with an absolute URI and tells whether the
+// client connection can be used for the next one.
+func (p *HTTPProxy) handleRequest(ctx context.Context, f *forwarder.Forwarder, conn net.Conn, req *http.Request, logger *log.Entry) (bool, error) {
+	if !req.URL.IsAbs() {
+		_, _ = io.Copy(ioutil.Discard, req.Body)
+		err := errorResponse(req, http.StatusBadRequest, "not a proxy request").Write(conn)
+		return !req.Close, err
+	}
+
+	logger.WithFields(log.Fields{
+		"method": req.Method,
+		"url":    req.URL.String(),
+	}).Debug("forwarding http request")
+
+	outReq := req.WithContext(ctx)
+	outReq.RequestURI = ""
+	outReq.Close = false
+	outReq.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		outReq.Header[k] = v
+	}
+	removeHopHeaders(outReq.Header)
+
+	resp, err := p.transport(f).RoundTrip(outReq)
+	if err != nil {
+		// The request body may be partially read, so the connection can't
+		// be reused.
+		resp := errorResponse(req, gatewayStatus(err), err.Error())
+		resp.Close = true
+		_ = resp.Write(conn)
+		return false, fmt.Errorf("http request failed, %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	removeHopHeaders(resp.Header)
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.TransferEncoding = nil
+	resp.Close = req.Close
+
+	// Bodies of unknown length are chunked for the client, or delimited by
+	// closing the connection if it can't do chunked encoding.
+	if resp.ContentLength < 0 && hasBody(req, resp) {
+		if req.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		} else {
+			resp.Close = true
+		}
+	}
+
+	if err := resp.Write(conn); err != nil {
+		return false, err
+	}
+
+	return !resp.Close, nil
+}
+
+func (p *HTTPProxy) transport(f *forwarder.Forwarder) *http.Transport {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.transports == nil {
+		p.transports = make(map[*forwarder.Forwarder]*http.Transport)
+	}
+
+	if t, ok := p.transports[f]; ok {
+		return t
+	}
+
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialCtx, dialCtxCancel := context.WithTimeout(ctx, f.DialTimeout)
+		defer dialCtxCancel()
+		return f.Dial(dialCtx, network, address)
+	}
+
+	t := &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		// The body is passed to the client as is.
+		DisableCompression: true,
+	}
+	p.transports[f] = t
+	return t
+}
+
+func errorResponse(req *http.Request, status int, msg string) *http.Response {
+	body := msg + "\n"
+	return &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         req.Close,
+		Request:       req,
+	}
+}
+
+func gatewayStatus(err error) int {
+	switch protocol.ErrorCodeOf(err) {
+	case protocol.CodeTimeout:
+		return http.StatusGatewayTimeout
+	case protocol.CodeNotAllowed:
+		return http.StatusForbidden
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+func hasBody(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode < 200,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func proxyCredentials(req *http.Request) (username, password string, ok bool) {
+	const prefix = "Basic "
+	auth := req.Header.Get("Proxy-Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+type bufferedConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
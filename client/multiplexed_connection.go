@@ -16,6 +16,20 @@ import (
 
 var ErrLimitExceeded = errors.New("connection limit exceeded")
 
+type lazyDialKey struct{}
+
+// WithLazyDial makes dials with the returned context return as soon as the
+// connection request is sent. The remote dial result is then reported on
+// the first Read instead of by DialContext.
+func WithLazyDial(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lazyDialKey{}, true)
+}
+
+func isLazyDial(ctx context.Context) bool {
+	lazy, _ := ctx.Value(lazyDialKey{}).(bool)
+	return lazy
+}
+
 type MultiplexedConnection struct {
 	config  *MultiplexedConnectionConfig
 	session *yamux.Session
@@ -30,6 +44,10 @@ type MultiplexedConnectionConfig struct {
 	RemoteDialTimeout         time.Duration
 	KeepAliveTimeout          time.Duration
 	Logger                    *log.Entry
+
+	// InitialResponse returns the response the server sent when the session
+	// was established, or nil if it hasn't arrived yet.
+	InitialResponse func() *protocol.ConnectionResponse
 }
 
 func NewMultiplexedConnection(conn net.Conn, config *MultiplexedConnectionConfig) (*MultiplexedConnection, error) {
@@ -56,13 +74,25 @@ func NewMultiplexedConnection(conn net.Conn, config *MultiplexedConnectionConfig
 }
 
 func (c *MultiplexedConnection) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network == "udp" || network == "udp4" || network == "udp6" {
+		if hello := c.serverHello(); hello != nil && !protocol.HasFeature(hello.Features, protocol.FeatureUDP) {
+			return nil, &protocol.RemoteError{Code: protocol.CodeNetworkNotSupported, Message: "udp not supported by server"}
+		}
+	}
+
+	if network == protocol.NetworkBind {
+		if hello := c.serverHello(); hello != nil && !protocol.HasFeature(hello.Features, protocol.FeatureBind) {
+			return nil, &protocol.RemoteError{Code: protocol.CodeNetworkNotSupported, Message: "bind not allowed by server"}
+		}
+	}
+
 	subConnID := c.registerConnect()
 	if subConnID == 0 {
 		return nil, ErrLimitExceeded
 	}
 
 	subConnIDStr := fmt.Sprintf("%v", subConnID)
-	max := c.config.MaxMultiplexedConnections
+	max := c.maxStreams()
 	if max > 0 {
 		subConnIDStr = fmt.Sprintf("%s/%v", subConnIDStr, max)
 	}
@@ -83,22 +113,89 @@ func (c *MultiplexedConnection) DialContext(ctx context.Context, network, addres
 	req := protocol.ConnectionRequest{
 		Network: network,
 		Address: address,
-		Timeout: c.config.RemoteDialTimeout,
+		Timeout: c.remoteDialTimeout(),
 	}
 
-	if err := protocol.WritePacket(ctx, conn, &req); err != nil {
+	if err := protocol.WriteFramedPacket(ctx, conn, c.framing(), &req); err != nil {
 		logger.WithError(err).Error("error while writing connection request")
+		_ = conn.Close()
 		c.registerDisconnect()
 		return nil, err
 	}
 
-	logger.Debug("lazy connect successful")
-
-	return &connectionWrapper{
+	cw := &connectionWrapper{
 		Conn:         conn,
 		onDisconnect: c.registerDisconnect,
 		logger:       logger,
-	}, nil
+	}
+
+	// Bind needs the listening address from the response.
+	if isLazyDial(ctx) && network != protocol.NetworkBind {
+		logger.Debug("lazy connect successful")
+		return cw, nil
+	}
+
+	cw.responseOnce.Do(func() { cw.readResponse(ctx) })
+	if cw.err != nil {
+		_ = cw.Close()
+		return nil, cw.err
+	}
+
+	if network == protocol.NetworkBind {
+		return &BindConn{cw}, nil
+	}
+
+	return cw, nil
+}
+
+// serverHello returns the hello of the server, or nil if it hasn't arrived
+// yet or the server doesn't negotiate features.
+func (c *MultiplexedConnection) serverHello() *protocol.ServerHello {
+	if c.config.InitialResponse == nil {
+		return nil
+	}
+
+	if resp := c.config.InitialResponse(); resp != nil {
+		return resp.Hello
+	}
+
+	return nil
+}
+
+func (c *MultiplexedConnection) framing() protocol.Framing {
+	// Until the server tells it accepts binary packets, JSON is used, so
+	// the first requests don't have to wait for the initial response.
+	if hello := c.serverHello(); hello != nil && protocol.HasFeature(hello.Features, protocol.FeatureBinaryFraming) {
+		return protocol.FramingBinary
+	}
+
+	return protocol.FramingJSON
+}
+
+func (c *MultiplexedConnection) maxStreams() int {
+	max := c.config.MaxMultiplexedConnections
+	if hello := c.serverHello(); hello != nil {
+		serverMax := hello.Limits.MaxStreamsPerSession
+		if serverMax > 0 && (max <= 0 || serverMax < max) {
+			max = serverMax
+		}
+	}
+
+	return max
+}
+
+// remoteDialTimeout is the configured timeout, lowered to the one of the
+// server, as waiting longer is pointless.
+func (c *MultiplexedConnection) remoteDialTimeout() time.Duration {
+	timeout := c.config.RemoteDialTimeout
+	if hello := c.serverHello(); hello != nil {
+		serverTimeout := hello.Limits.DialTimeout
+		if serverTimeout > 0 && (timeout <= 0 || serverTimeout < timeout) {
+			timeout = serverTimeout
+		}
+	}
+
+	return timeout
 }
 
 func (c *MultiplexedConnection) Close() {
@@ -136,7 +233,7 @@ func (c *MultiplexedConnection) registerConnect() int {
 		return 0
 	}
 
-	max := c.config.MaxMultiplexedConnections
+	max := c.maxStreams()
 
 	c.cntUsed++
 	c.cntActive++
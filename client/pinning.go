@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PinMismatchError means the server presented a certificate chain that
+// matches none of the configured pins. This is what an interception proxy
+// with a locally trusted CA looks like.
+type PinMismatchError struct {
+	// KeyHash is the base64 SHA-256 hash of the server public key, in the
+	// format of pinned_keys.
+	KeyHash string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("server certificate doesn't match any pin (server key is %v)", e.KeyHash)
+}
+
+// requestErrorCause returns the error behind a failed HTTP request, so a pin
+// mismatch of a polling session is recognized as such.
+func requestErrorCause(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return ue.Err
+	}
+	return err
+}
+
+func logHandshakeError(logger *log.Entry, err error) {
+	if _, ok := err.(*PinMismatchError); ok {
+		logger.WithError(err).Error("server certificate pin mismatch, connection may be intercepted")
+	} else {
+		logger.WithError(err).Error("tls handshake failed")
+	}
+}
+
+func loadCAFile(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %v", filename)
+	}
+	return pool, nil
+}
+
+// pinVerifier makes a tls.Config.VerifyPeerCertificate function checking the
+// certificates presented by the server against the pins, for use with
+// InsecureSkipVerify: the pins replace the usual chain check, so self-signed
+// and private CA certificates can be pinned too. A pinned leaf is accepted as
+// is. Otherwise the leaf must be issued for serverName by a pinned
+// certificate, either one presented by the server or one of a chain verified
+// against roots (the system roots if nil), which is how a root CA is pinned.
+// Keys are pinned by base64 SHA-256 of SubjectPublicKeyInfo, certificates by
+// hex SHA-256 of the whole certificate (colons allowed).
+func pinVerifier(serverName string, roots *x509.CertPool, pinnedKeys, pinnedCerts []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	var keys, certs [][]byte
+	for _, p := range pinnedKeys {
+		h, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, "sha256/"))
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid key pin %#v", p)
+		}
+		keys = append(keys, h)
+	}
+
+	for _, p := range pinnedCerts {
+		h, err := hex.DecodeString(strings.Replace(p, ":", "", -1))
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %#v", p)
+		}
+		certs = append(certs, h)
+	}
+
+	pinned := func(cert *x509.Certificate) bool {
+		keyHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		certHash := sha256.Sum256(cert.Raw)
+		return containsHash(keys, keyHash[:]) || containsHash(certs, certHash[:])
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		var presented []*x509.Certificate
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			presented = append(presented, cert)
+		}
+
+		if len(presented) == 0 {
+			return errors.New("server presented no certificate")
+		}
+
+		leaf := presented[0]
+		if pinned(leaf) {
+			return nil
+		}
+
+		opts := x509.VerifyOptions{
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range presented[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		for _, cert := range presented[1:] {
+			if !pinned(cert) {
+				continue
+			}
+
+			opts.Roots = x509.NewCertPool()
+			opts.Roots.AddCert(cert)
+			if _, err := leaf.Verify(opts); err == nil {
+				return nil
+			}
+		}
+
+		opts.Roots = roots
+		if chains, err := leaf.Verify(opts); err == nil {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if pinned(cert) {
+						return nil
+					}
+				}
+			}
+		}
+
+		leafKeyHash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		return &PinMismatchError{KeyHash: base64.StdEncoding.EncodeToString(leafKeyHash[:])}
+	}, nil
+}
+
+func containsHash(hashes [][]byte, h []byte) bool {
+	for _, candidate := range hashes {
+		if bytes.Equal(candidate, h) {
+			return true
+		}
+	}
+	return false
+}
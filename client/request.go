@@ -0,0 +1,201 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// RequestConfig shapes the HTTP requests of the client to look like the ones
+// of a browser.
+type RequestConfig struct {
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Cookies map[string]string `yaml:"cookies"`
+
+	// HeaderOrder lists header names in the order they are written, the
+	// rest follows sorted. Only honored by HTTP/1.1 transports.
+	HeaderOrder []string `yaml:"header_order"`
+
+	// WarmUp lists pages of the cover site fetched on the same connection
+	// before the tunnel is established.
+	WarmUp []string `yaml:"warm_up"`
+}
+
+// defaultHeaderOrder is how Chrome orders headers of navigation and
+// websocket requests.
+var defaultHeaderOrder = []string{
+	"Host",
+	"Connection",
+	"Pragma",
+	"Cache-Control",
+	"Upgrade-Insecure-Requests",
+	"User-Agent",
+	"Upgrade",
+	"Origin",
+	"Sec-WebSocket-Version",
+	"Accept",
+	"Sec-Fetch-Site",
+	"Sec-Fetch-Mode",
+	"Sec-Fetch-User",
+	"Sec-Fetch-Dest",
+	"Referer",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Sec-WebSocket-Key",
+	"Cookie",
+}
+
+func (rc *RequestConfig) headerOrder() []string {
+	if len(rc.HeaderOrder) > 0 {
+		return rc.HeaderOrder
+	}
+	return defaultHeaderOrder
+}
+
+// baseHeader makes the configured headers and cookies, extraCookies are
+// added to the latter.
+func (rc *RequestConfig) baseHeader(extraCookies ...*http.Cookie) http.Header {
+	h := make(http.Header)
+	h.Set("User-Agent", "")
+	for name, value := range rc.Headers {
+		h.Set(name, value)
+	}
+
+	var names []string
+	for name := range rc.Cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var cookies []string
+	for _, name := range names {
+		cookies = append(cookies, (&http.Cookie{Name: name, Value: rc.Cookies[name]}).String())
+	}
+	for _, cookie := range extraCookies {
+		cookies = append(cookies, cookie.String())
+	}
+
+	if len(cookies) > 0 {
+		h.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	return h
+}
+
+// writeRequest writes a body-less HTTP/1.1 request with headers in the given
+// order, unlike http.Request.Write which sorts them.
+func writeRequest(w io.Writer, req *http.Request, order []string) error {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	header := make(http.Header, len(req.Header)+1)
+	for name, values := range req.Header {
+		header[name] = values
+	}
+	header.Set("Host", host)
+
+	var buf bytes.Buffer
+	buf.WriteString(req.Method + " " + req.URL.RequestURI() + " HTTP/1.1\r\n")
+
+	writeHeader := func(name string) {
+		for _, value := range header[name] {
+			if value != "" {
+				buf.WriteString(name + ": " + value + "\r\n")
+			}
+		}
+		delete(header, name)
+	}
+
+	for _, name := range order {
+		writeHeader(http.CanonicalHeaderKey(name))
+	}
+
+	var rest []string
+	for name := range header {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		writeHeader(name)
+	}
+
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (c *Connector) warmUpRequests(base *url.URL) ([]*http.Request, error) {
+	var reqs []*http.Request
+	for _, page := range c.Config.Request.WarmUp {
+		ref, err := url.Parse(page)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest("GET", base.ResolveReference(ref).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header = c.Config.Request.baseHeader()
+		if c.Config.HostHeader != "" {
+			req.Host = c.Config.HostHeader
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// warmUpHTTP1 fetches the pages on conn, returning the connection to use
+// afterwards.
+func warmUpHTTP1(conn net.Conn, reqs []*http.Request, order []string) (net.Conn, error) {
+	if len(reqs) == 0 {
+		return conn, nil
+	}
+
+	br := bufio.NewReader(conn)
+	for _, req := range reqs {
+		if err := writeRequest(conn, req, order); err != nil {
+			return nil, err
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := discardBody(resp); err != nil {
+			return nil, err
+		}
+
+		if resp.Close {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+
+	return &bufferedConn{r: br, Conn: conn}, nil
+}
+
+func discardBody(resp *http.Response) error {
+	_, err := io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return err
+}
+
+type bufferedConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestWriteRequestHeaderOrder(t *testing.T) {
+	rc := &RequestConfig{
+		Headers: map[string]string{
+			"accept":          "text/html",
+			"Accept-Language": "en-US",
+			"X-Custom":        "1",
+			"Cache-Control":   "no-cache",
+			"Authorization":   "Bearer t",
+		},
+		Cookies: map[string]string{"b": "2", "a": "1"},
+	}
+
+	tests := []struct {
+		order []string
+		want  string
+	}{
+		{
+			rc.headerOrder(),
+			"GET /base/establish?x=1 HTTP/1.1\r\n" +
+				"Host: front.example.com\r\n" +
+				"Cache-Control: no-cache\r\n" +
+				"Accept: text/html\r\n" +
+				"Accept-Language: en-US\r\n" +
+				"Cookie: a=1; b=2; session=t\r\n" +
+				"Authorization: Bearer t\r\n" +
+				"X-Custom: 1\r\n" +
+				"\r\n",
+		},
+		{
+			[]string{"x-custom", "cookie"},
+			"GET /base/establish?x=1 HTTP/1.1\r\n" +
+				"X-Custom: 1\r\n" +
+				"Cookie: a=1; b=2; session=t\r\n" +
+				"Accept: text/html\r\n" +
+				"Accept-Language: en-US\r\n" +
+				"Authorization: Bearer t\r\n" +
+				"Cache-Control: no-cache\r\n" +
+				"Host: front.example.com\r\n" +
+				"\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "https://origin.example.com/base/establish?x=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = rc.baseHeader(&http.Cookie{Name: "session", Value: "t"})
+		req.Host = "front.example.com"
+
+		var buf bytes.Buffer
+		if err := writeRequest(&buf, req, tt.order); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("order %v: wrote\n%s\nwant\n%s", tt.order, buf.String(), tt.want)
+		}
+
+		// The request must still be valid HTTP.
+		if _, err := http.ReadRequest(bufio.NewReader(&buf)); err != nil {
+			t.Errorf("order %v: %v", tt.order, err)
+		}
+	}
+}
+
+func TestWarmUpHTTP1(t *testing.T) {
+	var m sync.Mutex
+	var paths, remotes []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		paths = append(paths, r.URL.Path)
+		remotes = append(remotes, r.RemoteAddr)
+		m.Unlock()
+
+		switch r.URL.Path {
+		case "/tunnel":
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = brw.WriteString("tunnel")
+			_ = brw.Flush()
+			_ = conn.Close()
+		case "/bye":
+			w.Header().Set("Connection", "close")
+			_, _ = w.Write([]byte("bye"))
+		default:
+			_, _ = w.Write(bytes.Repeat([]byte("cover "), 1000))
+		}
+	}))
+	defer srv.Close()
+
+	base, _ := url.Parse(srv.URL + "/")
+	c := &Connector{Config: &Config{Request: RequestConfig{WarmUp: []string{"/", "style.css"}}}}
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	reqs, err := c.warmUpRequests(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warm, err := warmUpHTTP1(conn, reqs, defaultHeaderOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnelReq, _ := http.NewRequest("GET", srv.URL+"/tunnel", nil)
+	if err := writeRequest(warm, tunnelReq, defaultHeaderOrder); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(warm, buf); err != nil || string(buf) != "tunnel" {
+		t.Fatalf("tunnel read %q, %v", buf, err)
+	}
+
+	m.Lock()
+	if len(paths) != 3 || paths[0] != "/" || paths[1] != "/style.css" || paths[2] != "/tunnel" {
+		t.Errorf("paths %v", paths)
+	}
+	for _, remote := range remotes {
+		if remote != remotes[0] {
+			t.Errorf("requests came on different connections: %v", remotes)
+		}
+	}
+	m.Unlock()
+
+	// A server closing the connection leaves no room for the tunnel.
+	conn2, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn2.Close() }()
+
+	c.Config.Request.WarmUp = []string{"/bye", "/"}
+	reqs, _ = c.warmUpRequests(base)
+	if _, err := warmUpHTTP1(conn2, reqs, defaultHeaderOrder); err != io.ErrUnexpectedEOF {
+		t.Errorf("warm-up on a closed connection: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
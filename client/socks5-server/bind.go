@@ -0,0 +1,60 @@
+package socks5_server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/neex/tcp-over-http/client/forwarder"
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+// bindConn is implemented by the connections the forwarder returns for
+// protocol.NetworkBind.
+type bindConn interface {
+	net.Conn
+	BoundAddr() string
+	AcceptPeer(ctx context.Context) (string, error)
+}
+
+// handleBind makes the server listen for the inbound connection expected from
+// address and relays it. reply is called twice on success, with the
+// listening address and with the address of the peer, and once with the error
+// otherwise.
+func handleBind(ctx context.Context, f *forwarder.Forwarder, conn net.Conn, address string, reply func(addr string, err error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, f.DialTimeout)
+	upstream, err := f.Dial(dialCtx, protocol.NetworkBind, address)
+	dialCtxCancel()
+	if err != nil {
+		reply("", err)
+		return fmt.Errorf("bind failed, %v", err)
+	}
+
+	bc, ok := upstream.(bindConn)
+	if !ok {
+		_ = upstream.Close()
+		err := &protocol.RemoteError{Code: protocol.CodeNetworkNotSupported, Message: "bind not supported"}
+		reply("", err)
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = bc.Close()
+	}()
+
+	reply(bc.BoundAddr(), nil)
+
+	peer, err := bc.AcceptPeer(ctx)
+	if err != nil {
+		reply("", err)
+		return fmt.Errorf("bind accept failed, %v", err)
+	}
+
+	reply(peer, nil)
+	forwarder.Relay(ctx, conn, bc)
+	return nil
+}
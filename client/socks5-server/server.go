@@ -7,14 +7,34 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/neex/tcp-over-http/client/forwarder"
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+const (
+	authNone     = 0
+	authPassword = 2
+
+	cmdConnect      = 1
+	cmdBind         = 2
+	cmdUDPAssociate = 3
 )
 
 type Socks5Server struct {
 	Forwarder *forwarder.Forwarder
+
+	// UDPIdleTimeout is how long a UDP flow to one destination lives without
+	// datagrams in either direction. Defaults to a minute.
+	UDPIdleTimeout time.Duration
+
+	// Authenticate, if set, makes the clients authenticate with username and
+	// password (RFC 1929). It returns the forwarder for the user's
+	// connections, or nil if the credentials are wrong.
+	Authenticate func(username, password string) *forwarder.Forwarder
 }
 
 func (p *Socks5Server) ListenAndServe(ctx context.Context, addr string) error {
@@ -52,6 +72,12 @@ func (p *Socks5Server) ListenAndServe(ctx context.Context, addr string) error {
 	}
 }
 
+// ServeConn serves a single client connection, e.g. one accepted by a
+// listener shared with another protocol.
+func (p *Socks5Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	return p.handleConn(ctx, conn)
+}
+
 func (p *Socks5Server) handleConn(ctx context.Context, conn net.Conn) error {
 	newCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -61,24 +87,37 @@ func (p *Socks5Server) handleConn(ctx context.Context, conn net.Conn) error {
 	}()
 
 	buf := make([]byte, 1024)
-	if n, err := io.ReadFull(conn, buf[:2]); n != 2 || err != nil {
+	if n, err := io.ReadFull(conn, buf[:1]); n != 1 || err != nil {
 		return fmt.Errorf("read short during first msg, %v", err)
 	}
 
+	if buf[0] == 4 {
+		return p.handleSocks4(ctx, conn)
+	}
+
 	if buf[0] != 5 {
 		return fmt.Errorf("wrong first byte, %v", buf[0])
 	}
 
-	cntAuth := int(buf[1])
+	if n, err := io.ReadFull(conn, buf[:1]); n != 1 || err != nil {
+		return fmt.Errorf("read short during first msg, %v", err)
+	}
+
+	cntAuth := int(buf[0])
 	if n, err := io.ReadFull(conn, buf[:cntAuth]); n != cntAuth || err != nil {
 		return fmt.Errorf("read short during reading auth methods, %v", err)
 	}
 
+	var wanted byte = authNone
+	if p.Authenticate != nil {
+		wanted = authPassword
+	}
+
 	var auth byte = 0xff
 
 	for i := 0; i < cntAuth; i++ {
-		if buf[i] == 0 {
-			auth = 0
+		if buf[i] == wanted {
+			auth = wanted
 		}
 	}
 
@@ -89,11 +128,19 @@ func (p *Socks5Server) handleConn(ctx context.Context, conn net.Conn) error {
 		return fmt.Errorf("invalid connection attempt: write short during hello, %v", err)
 	}
 
-	if auth != 0 {
+	if auth == 0xff {
 		return errors.New("auth not found")
 	}
 
-	if n, err := io.ReadFull(conn, buf[:4]); n != 4 || err != nil {
+	f := p.Forwarder
+	if auth == authPassword {
+		var err error
+		if f, err = p.authenticate(conn); err != nil {
+			return err
+		}
+	}
+
+	if n, err := io.ReadFull(conn, buf[:3]); n != 3 || err != nil {
 		return fmt.Errorf("read short during request, %v", err)
 	}
 
@@ -101,63 +148,199 @@ func (p *Socks5Server) handleConn(ctx context.Context, conn net.Conn) error {
 	resp[0] = 5
 	resp[3] = 1
 
-	if buf[0] != 5 || buf[1] != 1 || buf[2] != 0 {
+	if buf[0] != 5 || buf[2] != 0 {
 		resp[1] = 7
 		_, _ = conn.Write(resp)
-		return fmt.Errorf("invalid request, %v", buf[:4])
+		return fmt.Errorf("invalid request, %v", buf[:3])
+	}
+
+	cmd := buf[1]
+	address, err := readAddress(conn)
+	if err != nil {
+		if err == errAddressType {
+			resp[1] = 8
+			_, _ = conn.Write(resp)
+		}
+		return err
+	}
+
+	switch cmd {
+	case cmdConnect:
+		return p.handleConnect(ctx, f, conn, address, resp)
+
+	case cmdBind:
+		return handleBind(ctx, f, conn, address, func(addr string, err error) {
+			if err != nil {
+				resp[1] = replyCode(err)
+				_, _ = conn.Write(resp)
+				return
+			}
+
+			bound, err := encodeAddress(addr)
+			if err != nil {
+				resp[1] = 1
+				_, _ = conn.Write(resp)
+				return
+			}
+			_, _ = conn.Write(append([]byte{5, 0, 0}, bound...))
+		})
+
+	case cmdUDPAssociate:
+		return p.handleUDPAssociate(ctx, f, conn, address)
+
+	default:
+		resp[1] = 7
+		_, _ = conn.Write(resp)
+		return fmt.Errorf("unsupported command %v", cmd)
+	}
+}
+
+func (p *Socks5Server) handleConnect(ctx context.Context, f *forwarder.Forwarder, conn net.Conn, address string, resp []byte) error {
+	err := f.ForwardConnection(ctx, &forwarder.ForwardRequest{
+		ClientConn: conn,
+		Network:    "tcp",
+		Address:    address,
+		OnConnected: func() {
+			_, _ = conn.Write(resp)
+		},
+	})
+
+	if err != nil {
+		resp[1] = replyCode(err)
+		_, _ = conn.Write(resp)
+		return fmt.Errorf("dial failed, %v", err)
+	}
+
+	return nil
+}
+
+// authenticate runs the username/password subnegotiation.
+func (p *Socks5Server) authenticate(conn net.Conn) (*forwarder.Forwarder, error) {
+	buf := make([]byte, 256)
+	if n, err := io.ReadFull(conn, buf[:2]); n != 2 || err != nil {
+		return nil, fmt.Errorf("read short during auth request, %v", err)
+	}
+
+	if buf[0] != 1 {
+		return nil, fmt.Errorf("wrong auth version, %v", buf[0])
+	}
+
+	l := int(buf[1])
+	if n, err := io.ReadFull(conn, buf[:l]); n != l || err != nil {
+		return nil, fmt.Errorf("read short during username read, %v", err)
+	}
+	username := string(buf[:l])
+
+	if n, err := io.ReadFull(conn, buf[:1]); n != 1 || err != nil {
+		return nil, fmt.Errorf("read short during password len read, %v", err)
+	}
+
+	l = int(buf[0])
+	if n, err := io.ReadFull(conn, buf[:l]); n != l || err != nil {
+		return nil, fmt.Errorf("read short during password read, %v", err)
+	}
+	password := string(buf[:l])
+
+	f := p.Authenticate(username, password)
+	if f == nil {
+		_, _ = conn.Write([]byte{1, 1})
+		return nil, fmt.Errorf("authentication failed for user %#v", username)
+	}
+
+	if _, err := conn.Write([]byte{1, 0}); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+var errAddressType = errors.New("unsupported address type")
+
+// readAddress reads the address type, the address and the port in the format
+// shared by requests and UDP datagram headers.
+func readAddress(r io.Reader) (string, error) {
+	buf := make([]byte, 256)
+	if n, err := io.ReadFull(r, buf[:1]); n != 1 || err != nil {
+		return "", fmt.Errorf("read short during address type read, %v", err)
 	}
 
 	var host string
-	switch buf[3] {
+	switch buf[0] {
 	case 1:
-		if n, err := io.ReadFull(conn, buf[:4]); n != 4 || err != nil {
-			return fmt.Errorf("read short during ipv4 read, %v", err)
+		if n, err := io.ReadFull(r, buf[:4]); n != 4 || err != nil {
+			return "", fmt.Errorf("read short during ipv4 read, %v", err)
 		}
 		host = net.IP(buf[:4]).String()
 
 	case 3:
-		if n, err := io.ReadFull(conn, buf[:1]); n != 1 || err != nil {
-			return fmt.Errorf("read short during hostname len read, %v", err)
+		if n, err := io.ReadFull(r, buf[:1]); n != 1 || err != nil {
+			return "", fmt.Errorf("read short during hostname len read, %v", err)
 		}
 		l := int(buf[0])
-		if n, err := io.ReadFull(conn, buf[:l]); n != l || err != nil {
-			return fmt.Errorf("read short during hostname read, %v", err)
+		if n, err := io.ReadFull(r, buf[:l]); n != l || err != nil {
+			return "", fmt.Errorf("read short during hostname read, %v", err)
 		}
 		host = string(buf[:l])
 
 	case 4:
-		if n, err := io.ReadFull(conn, buf[:16]); n != 16 || err != nil {
-			return fmt.Errorf("read short during ipv6 read, %v", err)
+		if n, err := io.ReadFull(r, buf[:16]); n != 16 || err != nil {
+			return "", fmt.Errorf("read short during ipv6 read, %v", err)
 		}
 		host = net.IP(buf[:16]).String()
 
 	default:
-		resp[1] = 7
-		_, _ = conn.Write(resp)
-		return fmt.Errorf("invalid request, %v", buf[:4])
+		return "", errAddressType
 	}
 
-	if n, err := io.ReadFull(conn, buf[:2]); n != 2 || err != nil {
-		return fmt.Errorf("read short during port read, %v", err)
+	if n, err := io.ReadFull(r, buf[:2]); n != 2 || err != nil {
+		return "", fmt.Errorf("read short during port read, %v", err)
 	}
 
 	port := strconv.Itoa(int(buf[0])*256 + int(buf[1]))
-	address := net.JoinHostPort(host, port)
+	return net.JoinHostPort(host, port), nil
+}
 
-	err := p.Forwarder.ForwardConnection(ctx, &forwarder.ForwardRequest{
-		ClientConn: conn,
-		Network:    "tcp",
-		Address:    address,
-		OnConnected: func() {
-			_, _ = conn.Write(resp)
-		},
-	})
+// encodeAddress is the reverse of readAddress.
+func encodeAddress(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
 
+	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
-		resp[1] = 4
-		_, _ = conn.Write(resp)
-		return fmt.Errorf("host unreachable, %v", err)
+		return nil, err
 	}
 
-	return nil
+	var b []byte
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		b = append([]byte{1}, ip.To4()...)
+	} else if ip != nil {
+		b = append([]byte{4}, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("too long hostname %#v", host)
+		}
+		b = append([]byte{3, byte(len(host))}, host...)
+	}
+
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+var replyCodes = map[protocol.ErrorCode]byte{
+	protocol.CodeGeneralFailure:      1,
+	protocol.CodeNotAllowed:          2,
+	protocol.CodeNetworkUnreachable:  3,
+	protocol.CodeHostUnreachable:     4,
+	protocol.CodeDNSFailure:          4,
+	protocol.CodeConnectionRefused:   5,
+	protocol.CodeTimeout:             6,
+	protocol.CodeNetworkNotSupported: 7,
+}
+
+func replyCode(err error) byte {
+	if code, ok := replyCodes[protocol.ErrorCodeOf(err)]; ok {
+		return code
+	}
+	return 1
 }
@@ -0,0 +1,121 @@
+package socks5_server
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/neex/tcp-over-http/client/forwarder"
+)
+
+func TestAuthenticate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	alice, bob := newEchoForwarder(), newEchoForwarder()
+	p := &Socks5Server{
+		Forwarder: newEchoForwarder().forwarder(),
+		Authenticate: func(username, password string) *forwarder.Forwarder {
+			switch {
+			case username == "alice" && password == "secret":
+				return alice.forwarder()
+			case username == "bob" && password == "":
+				return bob.forwarder()
+			}
+			return nil
+		},
+	}
+
+	tests := []struct {
+		username, password string
+		echo               *echoForwarder
+	}{
+		{"alice", "secret", alice},
+		{"bob", "", bob},
+		{"alice", "wrong", nil},
+		{"", "secret", nil},
+		{"mallory", "secret", nil},
+	}
+
+	for _, tt := range tests {
+		conn := serveOne(ctx, t, p)
+
+		// Password is offered along with no authentication.
+		if _, err := conn.Write([]byte{5, 2, authNone, authPassword}); err != nil {
+			t.Fatal(err)
+		}
+
+		hello := make([]byte, 2)
+		if _, err := io.ReadFull(conn, hello); err != nil || hello[1] != authPassword {
+			t.Fatalf("hello %v, %v", hello, err)
+		}
+
+		msg := append([]byte{1, byte(len(tt.username))}, tt.username...)
+		msg = append(append(msg, byte(len(tt.password))), tt.password...)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil || status[0] != 1 {
+			t.Fatalf("%v: auth status %v, %v", tt.username, status, err)
+		}
+
+		if tt.echo == nil {
+			if status[1] == 0 {
+				t.Errorf("%v/%v: authenticated", tt.username, tt.password)
+			}
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Errorf("%v/%v: connection open after failed auth", tt.username, tt.password)
+			}
+			_ = conn.Close()
+			continue
+		}
+
+		if status[1] != 0 {
+			t.Fatalf("%v: auth failed", tt.username)
+		}
+
+		// The connection goes through the forwarder of the user.
+		addr, err := encodeAddress("example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(append([]byte{5, cmdConnect, 0}, addr...)); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := make([]byte, 10)
+		if _, err := io.ReadFull(conn, resp); err != nil || resp[1] != 0 {
+			t.Fatalf("%v: connect reply %v, %v", tt.username, resp, err)
+		}
+
+		if _, err := conn.Write([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 7)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "echo:hi" {
+			t.Errorf("%v: read %q, %v", tt.username, buf, err)
+		}
+
+		if dials, _ := tt.echo.state(); len(dials) != 1 || dials[0] != "tcp example.com:80" {
+			t.Errorf("%v: dials %v", tt.username, dials)
+		}
+		_ = conn.Close()
+	}
+
+	// Clients not offering the password method are refused.
+	conn := serveOne(ctx, t, p)
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte{5, 1, authNone}); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hello); err != nil || hello[1] != 0xff {
+		t.Errorf("hello without password method %v, %v", hello, err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection open without authentication")
+	}
+}
@@ -0,0 +1,123 @@
+package socks5_server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/neex/tcp-over-http/client/forwarder"
+)
+
+const (
+	socks4Granted  = 90
+	socks4Rejected = 91
+)
+
+// handleSocks4 serves SOCKS4 and SOCKS4a requests, the version byte is
+// already read.
+func (p *Socks5Server) handleSocks4(ctx context.Context, conn net.Conn) error {
+	// The request ends with null-terminated strings, so it can't be read in
+	// exact chunks; nothing follows it until the reply is sent, though.
+	r := bufio.NewReader(conn)
+
+	buf := make([]byte, 7)
+	if n, err := io.ReadFull(r, buf); n != 7 || err != nil {
+		return fmt.Errorf("read short during socks4 request, %v", err)
+	}
+
+	cmd := buf[0]
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buf[1:3])))
+	ip := net.IP(buf[3:7])
+
+	userID, err := readNullTerminated(r)
+	if err != nil {
+		return err
+	}
+
+	host := ip.String()
+	// 0.0.0.x with non-zero x means that the hostname follows (SOCKS4a).
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNullTerminated(r); err != nil {
+			return err
+		}
+	}
+
+	if r.Buffered() > 0 {
+		return errors.New("unexpected data after socks4 request")
+	}
+
+	address := net.JoinHostPort(host, port)
+
+	// SOCKS4 has no passwords.
+	if p.Authenticate != nil {
+		_, _ = conn.Write(socks4Reply(socks4Rejected, ""))
+		return fmt.Errorf("socks4 request from user %#v refused, authentication is required", userID)
+	}
+
+	switch cmd {
+	case cmdConnect:
+		err := p.Forwarder.ForwardConnection(ctx, &forwarder.ForwardRequest{
+			ClientConn: conn,
+			Network:    "tcp",
+			Address:    address,
+			OnConnected: func() {
+				_, _ = conn.Write(socks4Reply(socks4Granted, ""))
+			},
+		})
+
+		if err != nil {
+			_, _ = conn.Write(socks4Reply(socks4Rejected, ""))
+			return fmt.Errorf("dial failed, %v", err)
+		}
+		return nil
+
+	case cmdBind:
+		return handleBind(ctx, p.Forwarder, conn, address, func(addr string, err error) {
+			code := byte(socks4Granted)
+			if err != nil {
+				code = socks4Rejected
+			}
+			_, _ = conn.Write(socks4Reply(code, addr))
+		})
+
+	default:
+		_, _ = conn.Write(socks4Reply(socks4Rejected, ""))
+		return fmt.Errorf("unsupported socks4 command %v", cmd)
+	}
+}
+
+// socks4Reply makes a reply carrying the address if it is an IPv4 one.
+func socks4Reply(code byte, addr string) []byte {
+	resp := make([]byte, 8)
+	resp[1] = code
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err == nil && tcpAddr.IP.To4() != nil {
+		binary.BigEndian.PutUint16(resp[2:4], uint16(tcpAddr.Port))
+		copy(resp[4:8], tcpAddr.IP.To4())
+	}
+
+	return resp
+}
+
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var s []byte
+	for len(s) < 256 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("read short during socks4 string read, %v", err)
+		}
+
+		if b == 0 {
+			return string(s), nil
+		}
+		s = append(s, b)
+	}
+
+	return "", errors.New("too long socks4 string")
+}
@@ -0,0 +1,313 @@
+package socks5_server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neex/tcp-over-http/client/forwarder"
+)
+
+const (
+	defaultUDPIdleTimeout = time.Minute
+	udpFlowQueueSize      = 64
+)
+
+// udpAssociation relays the datagrams of a single UDP ASSOCIATE request. Each
+// destination gets its own flow, i.e. its own UDP stream through the tunnel.
+type udpAssociation struct {
+	forwarder   *forwarder.Forwarder
+	relay       *net.UDPConn
+	clientIP    net.IP
+	idleTimeout time.Duration
+	logger      *log.Entry
+
+	m      sync.Mutex
+	client *net.UDPAddr
+	flows  map[string]*udpFlow
+}
+
+type udpFlow struct {
+	lastActive int64 // unix nanoseconds, accessed atomically
+
+	address string
+	header  []byte
+	packets chan []byte
+	cancel  context.CancelFunc
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.lastActive)))
+}
+
+func (p *Socks5Server) handleUDPAssociate(ctx context.Context, f *forwarder.Forwarder, conn net.Conn, address string) error {
+	newCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp := []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ok2 {
+		_, _ = conn.Write(resp)
+		return fmt.Errorf("udp associate over non-tcp connection")
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		_, _ = conn.Write(resp)
+		return fmt.Errorf("udp relay listen failed, %v", err)
+	}
+
+	go func() {
+		<-newCtx.Done()
+		_ = relay.Close()
+	}()
+
+	a := &udpAssociation{
+		forwarder:   f,
+		relay:       relay,
+		clientIP:    remoteAddr.IP,
+		idleTimeout: p.UDPIdleTimeout,
+		logger:      log.WithField("remote_addr", remoteAddr).WithField("relay_addr", relay.LocalAddr()),
+		flows:       make(map[string]*udpFlow),
+	}
+
+	if a.idleTimeout == 0 {
+		a.idleTimeout = defaultUDPIdleTimeout
+	}
+
+	// The client may tell in advance where its datagrams come from.
+	if host, port, err := net.SplitHostPort(address); err == nil && port != "0" {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			a.client, _ = net.ResolveUDPAddr("udp", address)
+		}
+	}
+
+	bound, err := encodeAddress(relay.LocalAddr().String())
+	if err != nil {
+		_, _ = conn.Write(resp)
+		return err
+	}
+
+	resp = append([]byte{5, 0, 0}, bound...)
+	if _, err := conn.Write(resp); err != nil {
+		return err
+	}
+
+	a.logger.Debug("udp association started")
+
+	go a.relayFromClient(newCtx)
+	go a.reapIdleFlows(newCtx)
+
+	// The association lives as long as the control connection.
+	_, _ = io.Copy(ioutil.Discard, conn)
+	a.logger.Debug("udp association finished")
+	return nil
+}
+
+func (a *udpAssociation) relayFromClient(ctx context.Context) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !a.acceptFrom(from) {
+			a.logger.WithField("from", from).Debug("datagram from foreign address dropped")
+			continue
+		}
+
+		address, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			a.logger.WithError(err).Debug("invalid datagram dropped")
+			continue
+		}
+
+		f := a.flow(ctx, address)
+		if f == nil {
+			continue
+		}
+		f.touch()
+
+		select {
+		case f.packets <- append([]byte(nil), payload...):
+		default:
+			a.logger.WithField("remote", address).Debug("udp flow queue is full, datagram dropped")
+		}
+	}
+}
+
+// acceptFrom checks that the datagram comes from the client of the
+// association. The first datagram fixes the client port unless it was given
+// in the request.
+func (a *udpAssociation) acceptFrom(from *net.UDPAddr) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.client == nil {
+		if !from.IP.Equal(a.clientIP) {
+			return false
+		}
+		a.client = from
+	}
+
+	return from.IP.Equal(a.client.IP) && from.Port == a.client.Port
+}
+
+func (a *udpAssociation) flow(ctx context.Context, address string) *udpFlow {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if f, ok := a.flows[address]; ok {
+		return f
+	}
+
+	header, err := encodeAddress(address)
+	if err != nil {
+		a.logger.WithError(err).Debug("invalid datagram destination")
+		return nil
+	}
+
+	flowCtx, cancel := context.WithCancel(ctx)
+	f := &udpFlow{
+		address: address,
+		header:  append([]byte{0, 0, 0}, header...),
+		packets: make(chan []byte, udpFlowQueueSize),
+		cancel:  cancel,
+	}
+	f.touch()
+	a.flows[address] = f
+
+	go a.runFlow(flowCtx, f)
+	return f
+}
+
+func (a *udpAssociation) removeFlow(f *udpFlow) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	f.cancel()
+	if a.flows[f.address] == f {
+		delete(a.flows, f.address)
+	}
+}
+
+func (a *udpAssociation) runFlow(ctx context.Context, f *udpFlow) {
+	defer a.removeFlow(f)
+
+	logger := a.logger.WithField("remote", f.address)
+
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, a.forwarder.DialTimeout)
+	upstream, err := a.forwarder.Dial(dialCtx, "udp", f.address)
+	dialCtxCancel()
+	if err != nil {
+		logger.WithError(err).Warn("udp dial failed")
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = upstream.Close()
+	}()
+
+	logger.Debug("udp flow started")
+
+	go func() {
+		defer f.cancel()
+		for {
+			select {
+			case packet := <-f.packets:
+				if _, err := upstream.Write(packet); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			break
+		}
+		f.touch()
+
+		if err := a.sendToClient(f.header, buf[:n]); err != nil {
+			logger.WithError(err).Debug("udp write to client failed")
+		}
+	}
+
+	logger.Debug("udp flow finished")
+}
+
+func (a *udpAssociation) sendToClient(header, payload []byte) error {
+	a.m.Lock()
+	client := a.client
+	a.m.Unlock()
+
+	if client == nil {
+		return nil
+	}
+
+	packet := make([]byte, 0, len(header)+len(payload))
+	packet = append(append(packet, header...), payload...)
+	_, err := a.relay.WriteToUDP(packet, client)
+	return err
+}
+
+func (a *udpAssociation) reapIdleFlows(ctx context.Context) {
+	ticker := time.NewTicker(a.idleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		a.m.Lock()
+		for _, f := range a.flows {
+			if f.idle() > a.idleTimeout {
+				f.cancel()
+			}
+		}
+		a.m.Unlock()
+	}
+}
+
+// parseUDPHeader strips the SOCKS5 UDP request header. Fragmented datagrams
+// are not supported and are rejected, as the RFC allows.
+func parseUDPHeader(packet []byte) (address string, payload []byte, err error) {
+	if len(packet) < 3 {
+		return "", nil, fmt.Errorf("too short datagram")
+	}
+
+	if packet[2] != 0 {
+		return "", nil, fmt.Errorf("fragmented datagram")
+	}
+
+	r := bytes.NewReader(packet[3:])
+	address, err = readAddress(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return address, packet[len(packet)-r.Len():], nil
+}
@@ -0,0 +1,247 @@
+package socks5_server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neex/tcp-over-http/client/forwarder"
+)
+
+// echoForwarder answers every udp dial with a stream echoing the datagrams
+// back, prefixed with "echo:". It records the dials and what was received.
+type echoForwarder struct {
+	m        sync.Mutex
+	dials    []string
+	received []string
+	closed   chan string
+}
+
+func newEchoForwarder() *echoForwarder {
+	return &echoForwarder{closed: make(chan string, 16)}
+}
+
+func (e *echoForwarder) forwarder() *forwarder.Forwarder {
+	return &forwarder.Forwarder{Dial: e.dial, DialTimeout: time.Second}
+}
+
+func (e *echoForwarder) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	e.m.Lock()
+	e.dials = append(e.dials, network+" "+address)
+	e.m.Unlock()
+
+	c1, c2 := net.Pipe()
+	go func() {
+		defer func() { e.closed <- address }()
+		buf := make([]byte, 65536)
+		for {
+			n, err := c2.Read(buf)
+			if err != nil {
+				return
+			}
+
+			e.m.Lock()
+			e.received = append(e.received, string(buf[:n]))
+			e.m.Unlock()
+
+			if _, err := c2.Write(append([]byte("echo:"), buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+	return c1, nil
+}
+
+func (e *echoForwarder) state() (dials, received []string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return append([]string(nil), e.dials...), append([]string(nil), e.received...)
+}
+
+// serveOne runs p on a single connection accepted from a local listener and
+// returns the client end.
+func serveOne(ctx context.Context, t *testing.T, p *Socks5Server) net.Conn {
+	t.Helper()
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = lsn.Close() }()
+
+	go func() {
+		conn, err := lsn.Accept()
+		if err != nil {
+			return
+		}
+		_ = p.ServeConn(ctx, conn)
+	}()
+
+	conn, err := net.Dial("tcp", lsn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// request sends the greeting with no authentication and a request, returning
+// the address in the reply.
+func request(t *testing.T, conn net.Conn, cmd byte, address string) string {
+	t.Helper()
+	if _, err := conn.Write([]byte{5, 1, authNone}); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hello); err != nil || hello[1] != authNone {
+		t.Fatalf("hello %v, %v", hello, err)
+	}
+
+	addr, err := encodeAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append([]byte{5, cmd, 0}, addr...)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := make([]byte, 3)
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[1] != 0 {
+		t.Fatalf("reply %v, %v", resp, err)
+	}
+
+	bound, err := readAddress(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bound
+}
+
+func udpPacket(t *testing.T, address, payload string) []byte {
+	t.Helper()
+	addr, err := encodeAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]byte{0, 0, 0}, addr...), payload...)
+}
+
+func TestParseUDPHeader(t *testing.T) {
+	tests := []struct {
+		packet  []byte
+		address string
+		payload string
+	}{
+		{[]byte{0, 0, 0, 1, 10, 0, 0, 1, 0, 53, 'h', 'i'}, "10.0.0.1:53", "hi"},
+		{[]byte{0, 0, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187}, "example.com:443", ""},
+		{append([]byte{0, 0, 0, 4, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90}, "data"...), "[2001:db8::1]:8080", "data"},
+		{[]byte{0, 0, 1, 1, 10, 0, 0, 1, 0, 53, 'h', 'i'}, "", ""},
+		{[]byte{0, 0, 0, 5, 10, 0, 0, 1, 0, 53}, "", ""},
+		{[]byte{0, 0, 0, 1, 10, 0}, "", ""},
+		{[]byte{0, 0}, "", ""},
+	}
+
+	for _, tt := range tests {
+		address, payload, err := parseUDPHeader(tt.packet)
+		if tt.address == "" {
+			if err == nil {
+				t.Errorf("%v: parsed as %v", tt.packet, address)
+			}
+			continue
+		}
+
+		if err != nil || address != tt.address || string(payload) != tt.payload {
+			t.Errorf("%v: got %v %q %v, want %v %q", tt.packet, address, payload, err, tt.address, tt.payload)
+		}
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := newEchoForwarder()
+	p := &Socks5Server{Forwarder: echo.forwarder(), UDPIdleTimeout: 200 * time.Millisecond}
+	conn := serveOne(ctx, t, p)
+	defer func() { _ = conn.Close() }()
+
+	relayAddr, err := net.ResolveUDPAddr("udp", request(t, conn, cmdUDPAssociate, "0.0.0.0:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	foreign, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = foreign.Close() }()
+
+	exchange := func(address, payload string) {
+		t.Helper()
+		if _, err := client.WriteToUDP(udpPacket(t, address, payload), relayAddr); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 65536)
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := udpPacket(t, address, "echo:"+payload); !bytes.Equal(buf[:n], want) {
+			t.Errorf("got datagram %q, want %q", buf[:n], want)
+		}
+	}
+
+	// The first datagram fixes the client, another port on the same host is
+	// foreign.
+	exchange("10.0.0.1:53", "one")
+	if _, err := foreign.WriteToUDP(udpPacket(t, "10.0.0.1:53", "foreign"), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	exchange("example.com:53", "two")
+	exchange("10.0.0.1:53", "three")
+
+	dials, received := echo.state()
+	if want := []string{"udp 10.0.0.1:53", "udp example.com:53"}; !equalStrings(dials, want) {
+		t.Errorf("dials %v, want %v", dials, want)
+	}
+	if want := []string{"one", "two", "three"}; !equalStrings(received, want) {
+		t.Errorf("received %v, want %v", received, want)
+	}
+
+	// Idle flows are closed and dialed again on the next datagram.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-echo.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("idle flow is not closed")
+		}
+	}
+
+	exchange("10.0.0.1:53", "four")
+	if dials, _ := echo.state(); len(dials) != 3 || dials[2] != "udp 10.0.0.1:53" {
+		t.Errorf("dials after reaping %v", dials)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
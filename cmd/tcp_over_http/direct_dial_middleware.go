@@ -9,6 +9,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/neex/tcp-over-http/common"
+	"github.com/neex/tcp-over-http/protocol"
 )
 
 func DirectDialMiddleware(directHosts *regexp.Regexp, timeout time.Duration, next common.DialContextFunc) common.DialContextFunc {
@@ -21,7 +22,8 @@ func DirectDialMiddleware(directHosts *regexp.Regexp, timeout time.Duration, nex
 			host = address
 		}
 
-		if directHosts.MatchString(host) {
+		// Bind needs the server, it can't be done directly.
+		if network != protocol.NetworkBind && directHosts.MatchString(host) {
 			logger := log.WithField("remote", address)
 			logger.Info("dialing without proxy")
 			conn, e = directDialer.DialContext(ctx, network, address)
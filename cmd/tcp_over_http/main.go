@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -14,8 +15,10 @@ import (
 
 	"github.com/neex/tcp-over-http/client"
 	"github.com/neex/tcp-over-http/client/forwarder"
+	httpproxy "github.com/neex/tcp-over-http/client/http-proxy"
 	socks5server "github.com/neex/tcp-over-http/client/socks5-server"
 	"github.com/neex/tcp-over-http/client/tun"
+	"github.com/neex/tcp-over-http/transport"
 )
 
 func main() {
@@ -27,8 +30,18 @@ func main() {
 		directDialCompiled *regexp.Regexp
 		poolSize           int
 		tunDevice          string
+		lazyDial           bool
+		httpAddr           string
+		mixed              bool
 	)
 
+	dialContext := func() context.Context {
+		if lazyDial {
+			return client.WithLazyDial(context.Background())
+		}
+		return context.Background()
+	}
+
 	cmdDial := &cobra.Command{
 		Use:   "dial [addr to dial]",
 		Short: "Dial to addr and connect to stdin/stdout",
@@ -40,7 +53,7 @@ func main() {
 
 			addr := args[0]
 
-			conn, err := dialer.DialContext(context.Background(), remoteNet, addr)
+			conn, err := dialer.DialContext(dialContext(), remoteNet, addr)
 			if err != nil {
 				log.WithError(err).Fatal("dial failed")
 			}
@@ -49,6 +62,7 @@ func main() {
 		},
 	}
 	cmdDial.PersistentFlags().StringVar(&remoteNet, "remote-net", "tcp", "remote network (tcp/udp)")
+	cmdDial.PersistentFlags().BoolVar(&lazyDial, "lazy", false, "don't wait for the remote dial result before sending data")
 
 	cmdForward := &cobra.Command{
 		Use:   "forward [local addr] [remote addr]",
@@ -75,9 +89,10 @@ func main() {
 				}
 
 				go func(c net.Conn) {
-					conn, err := dialer.DialContext(context.Background(), remoteNet, remoteAddr)
+					conn, err := dialer.DialContext(dialContext(), remoteNet, remoteAddr)
 					if err != nil {
-						log.WithError(err).Error("dial failed early")
+						log.WithError(err).Error("dial failed")
+						_ = c.Close()
 						return
 					}
 
@@ -88,10 +103,11 @@ func main() {
 	}
 	cmdForward.PersistentFlags().IntVar(&poolSize, "preconnect-pool", 5, "preconnect pool size")
 	cmdForward.PersistentFlags().StringVar(&remoteNet, "remote-net", "tcp", "remote network (tcp/udp)")
+	cmdForward.PersistentFlags().BoolVar(&lazyDial, "lazy", false, "don't wait for the remote dial result before sending data")
 
 	cmdProxy := &cobra.Command{
 		Use:   "proxy [local addr]",
-		Short: "Run socks5 server on local addr, optionally also forward tun connections",
+		Short: "Run socks5 server on local addr, optionally also http proxy and tun forwarding",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			localAddr := args[0]
@@ -122,8 +138,40 @@ func main() {
 				}
 			}
 
+			authenticate, err := ProxyAuthenticator(dialer.Connector.Config.ProxyUsers, dialer, directDialCompiled, f.DialTimeout)
+			if err != nil {
+				log.WithError(err).Fatal("invalid proxy users")
+			}
+
 			server := &socks5server.Socks5Server{
-				Forwarder: f,
+				Forwarder:    f,
+				Authenticate: authenticate,
+			}
+
+			httpProxy := &httpproxy.HTTPProxy{
+				Forwarder:    f,
+				Authenticate: authenticate,
+			}
+
+			if httpAddr != "" {
+				go func() {
+					if err := httpProxy.ListenAndServe(context.Background(), httpAddr); err != nil {
+						log.WithError(err).Fatal("http proxy listen failed")
+					}
+				}()
+			}
+
+			if mixed {
+				mixedProxy := &httpproxy.HTTPProxy{
+					Forwarder:    f,
+					Authenticate: authenticate,
+					Socks:        server,
+				}
+
+				if err := mixedProxy.ListenAndServe(context.Background(), localAddr); err != nil {
+					log.WithError(err).Fatal("proxy listen failed")
+				}
+				return
 			}
 
 			if err := server.ListenAndServe(context.Background(), localAddr); err != nil {
@@ -134,6 +182,8 @@ func main() {
 	cmdProxy.PersistentFlags().IntVar(&poolSize, "preconnect-pool", 5, "preconnect pool size")
 	cmdProxy.PersistentFlags().StringVar(&directDialRegexp, "direct-dial", "", "the regexp for addresses that should be dialed without proxy")
 	cmdProxy.PersistentFlags().StringVar(&tunDevice, "tun", "", "tun device to listen on")
+	cmdProxy.PersistentFlags().StringVar(&httpAddr, "http", "", "also run http proxy on addr")
+	cmdProxy.PersistentFlags().BoolVar(&mixed, "mixed", false, "serve http proxy clients on the socks5 port as well")
 	cmdProxy.PreRunE = func(cmd *cobra.Command, args []string) error {
 		if directDialRegexp == "" {
 			return nil
@@ -146,9 +196,25 @@ func main() {
 		return nil
 	}
 
+	cmdNoiseKeygen := &cobra.Command{
+		Use:   "noise-keygen",
+		Short: "Generate a key pair for the noise encryption layer",
+		Args:  cobra.NoArgs,
+		// The config isn't needed to generate keys.
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+		Run: func(cmd *cobra.Command, args []string) {
+			private, public, err := transport.GenerateNoiseKey()
+			if err != nil {
+				log.WithError(err).Fatal("key generation failed")
+			}
+
+			fmt.Printf("private_key: %s\npublic_key: %s\n", private, public)
+		},
+	}
+
 	var configFilename string
 	rootCmd := &cobra.Command{Use: "tcp_over_http"}
-	rootCmd.AddCommand(cmdDial, cmdForward, cmdProxy)
+	rootCmd.AddCommand(cmdDial, cmdForward, cmdProxy, cmdNoiseKeygen)
 	rootCmd.PersistentFlags().StringVarP(&configFilename, "config", "c", "./config.yaml", "path to config")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "loglevel", "", "loglevel")
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/neex/tcp-over-http/client"
+	"github.com/neex/tcp-over-http/client/forwarder"
+	"github.com/neex/tcp-over-http/common"
+)
+
+type proxyUser struct {
+	password  string
+	forwarder *forwarder.Forwarder
+}
+
+// ProxyAuthenticator returns the function checking the credentials of the
+// local proxy users, or nil if there are no users configured. Every user gets
+// its own forwarder, which uses the user's upstream server and direct dial
+// regexp, if any, and the defaults otherwise. Upstream servers get a
+// preconnect pool of the size dialer has.
+func ProxyAuthenticator(users []client.ProxyUser, dialer *client.Dialer, directDial *regexp.Regexp, dialTimeout time.Duration) (func(username, password string) *forwarder.Forwarder, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	byName := make(map[string]*proxyUser)
+	for _, u := range users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("proxy user without name")
+		}
+
+		if byName[u.Name] != nil {
+			return nil, fmt.Errorf("duplicate proxy user %#v", u.Name)
+		}
+
+		var dial common.DialContextFunc = dialer.DialContext
+		if u.Upstream != nil {
+			upstream := &client.Dialer{
+				Connector:          &client.Connector{Config: u.Upstream},
+				PreconnectPoolSize: dialer.PreconnectPoolSize,
+			}
+			upstream.EnablePreconnect()
+			dial = upstream.DialContext
+		}
+
+		re := directDial
+		if u.DirectDial != "" {
+			var err error
+			if re, err = regexp.Compile(u.DirectDial); err != nil {
+				return nil, fmt.Errorf("direct_dial of proxy user %#v: %v", u.Name, err)
+			}
+		}
+
+		if re != nil {
+			dial = DirectDialMiddleware(re, 20*time.Second, dial)
+		}
+
+		byName[u.Name] = &proxyUser{
+			password:  u.Password,
+			forwarder: &forwarder.Forwarder{Dial: dial, DialTimeout: dialTimeout},
+		}
+	}
+
+	return func(username, password string) *forwarder.Forwarder {
+		u := byName[username]
+		if u == nil || subtle.ConstantTimeCompare([]byte(u.password), []byte(password)) != 1 {
+			return nil
+		}
+		return u.forwarder
+	}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/neex/tcp-over-http/client"
+)
+
+func TestProxyAuthenticator(t *testing.T) {
+	if auth, err := ProxyAuthenticator(nil, nil, nil, time.Second); auth != nil || err != nil {
+		t.Errorf("no users: authenticator %v, error %v", auth != nil, err)
+	}
+
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = lsn.Close() }()
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Nothing listens on the servers, so only direct dials succeed.
+	dialer := &client.Dialer{Connector: &client.Connector{Config: &client.Config{Address: "http://127.0.0.1:1/"}}}
+	users := []client.ProxyUser{
+		{Name: "alice", Password: "a"},
+		{Name: "bob", Password: "b", DirectDial: `^127\.`},
+		{Name: "carol", Password: "c", Upstream: &client.Config{Address: "http://127.0.0.1:1/"}},
+	}
+
+	auth, err := ProxyAuthenticator(users, dialer, regexp.MustCompile(`^localhost$`), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, creds := range [][2]string{{"alice", "b"}, {"alice", ""}, {"dave", "a"}, {"", ""}} {
+		if auth(creds[0], creds[1]) != nil {
+			t.Errorf("%v/%v authenticated", creds[0], creds[1])
+		}
+	}
+
+	tests := []struct {
+		name, password string
+		direct         bool
+	}{
+		{"alice", "a", false},
+		{"bob", "b", true},
+		{"carol", "c", false},
+	}
+
+	for _, tt := range tests {
+		f := auth(tt.name, tt.password)
+		if f == nil {
+			t.Fatalf("%v not authenticated", tt.name)
+		}
+		if f != auth(tt.name, tt.password) {
+			t.Errorf("%v: forwarder differs between calls", tt.name)
+		}
+		if f.DialTimeout != 3*time.Second {
+			t.Errorf("%v: dial timeout %v", tt.name, f.DialTimeout)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := f.Dial(ctx, "tcp", lsn.Addr().String())
+		cancel()
+		if conn != nil {
+			_ = conn.Close()
+		}
+		if (err == nil) != tt.direct {
+			t.Errorf("%v: dial error %v, want direct %v", tt.name, err, tt.direct)
+		}
+	}
+
+	invalid := [][]client.ProxyUser{
+		{{Password: "a"}},
+		{{Name: "alice"}, {Name: "alice"}},
+		{{Name: "alice", DirectDial: "("}},
+	}
+
+	for _, users := range invalid {
+		if _, err := ProxyAuthenticator(users, dialer, nil, time.Second); err == nil {
+			t.Errorf("users %+v accepted", users)
+		}
+	}
+}
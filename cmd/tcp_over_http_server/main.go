@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 
@@ -18,6 +20,29 @@ func main() {
 		log.WithError(err).Fatal("loading config")
 	}
 
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		for range sigs {
+			needRestart, err := config.Reload(os.Args[1])
+			if err != nil {
+				log.WithError(err).Error("reloading config")
+			} else {
+				log.Info("users and acl reloaded")
+			}
+
+			if len(needRestart) > 0 {
+				log.WithField("settings", needRestart).Warn("changed settings need a restart to take effect")
+			}
+
+			if err := config.ReloadCertificates(); err != nil {
+				log.WithError(err).Error("reloading certificate")
+			}
+		}
+	}()
+
+	config.WatchCertificates()
+
 	if config.RedirectorAddr != "" {
 		go func() {
 			if err := server.RunRedirectorServer(config); err != nil {
@@ -3,10 +3,14 @@ module github.com/neex/tcp-over-http
 go 1.12
 
 require (
+	github.com/flynn/noise v1.0.0
 	github.com/google/btree v1.0.0 // indirect
 	github.com/google/netstack v0.0.0-20190806180032-4e5848a54239
 	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d
+	github.com/refraction-networking/utls v1.0.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	gopkg.in/yaml.v2 v2.2.2
 )
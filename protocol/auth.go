@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// DefaultAuthCookie is the cookie carrying the auth token unless configured
+// otherwise. It shouldn't clash with the cookies of the cover site.
+const DefaultAuthCookie = "_toh_sid"
+
+const (
+	authNonceSize = 16
+	authTokenSize = 8 + authNonceSize + sha256.Size
+)
+
+var errBadAuthToken = errors.New("malformed auth token")
+
+// AuthToken proves the knowledge of a user key without revealing it. It
+// consists of a timestamp, a random nonce and an HMAC of both, so it is only
+// valid for a short time and can be used only once.
+type AuthToken struct {
+	Timestamp time.Time
+	Nonce     []byte
+	mac       []byte
+}
+
+// NewAuthToken makes an encoded auth token for the key.
+func NewAuthToken(key string, now time.Time) string {
+	buf := make([]byte, authTokenSize)
+	binary.BigEndian.PutUint64(buf, uint64(now.Unix()))
+	_, _ = rand.Read(buf[8 : 8+authNonceSize])
+	copy(buf[8+authNonceSize:], authMAC(key, buf[:8+authNonceSize]))
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func ParseAuthToken(s string) (*AuthToken, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) != authTokenSize {
+		return nil, errBadAuthToken
+	}
+
+	return &AuthToken{
+		Timestamp: time.Unix(int64(binary.BigEndian.Uint64(buf)), 0),
+		Nonce:     buf[8 : 8+authNonceSize],
+		mac:       buf[8+authNonceSize:],
+	}, nil
+}
+
+// Verify checks that the token was made with the key.
+func (t *AuthToken) Verify(key string) bool {
+	signed := make([]byte, 8, 8+authNonceSize)
+	binary.BigEndian.PutUint64(signed, uint64(t.Timestamp.Unix()))
+	signed = append(signed, t.Nonce...)
+	return hmac.Equal(t.mac, authMAC(key, signed))
+}
+
+func authMAC(key string, data []byte) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	_, _ = h.Write([]byte("tcp-over-http auth\x00"))
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthToken(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	encoded := NewAuthToken("key", now)
+
+	token, err := ParseAuthToken(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !token.Timestamp.Equal(now) {
+		t.Errorf("timestamp %v, want %v", token.Timestamp, now)
+	}
+
+	if len(token.Nonce) != authNonceSize {
+		t.Errorf("nonce length %v", len(token.Nonce))
+	}
+
+	if !token.Verify("key") {
+		t.Error("token not verified with its key")
+	}
+
+	if token.Verify("other key") || token.Verify("") {
+		t.Error("token verified with a wrong key")
+	}
+
+	if other, _ := ParseAuthToken(NewAuthToken("key", now)); string(other.Nonce) == string(token.Nonce) {
+		t.Error("nonce repeated")
+	}
+}
+
+func TestAuthTokenTampered(t *testing.T) {
+	encoded := NewAuthToken("key", time.Now())
+	token, err := ParseAuthToken(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token.Timestamp = token.Timestamp.Add(time.Hour)
+	if token.Verify("key") {
+		t.Error("token with changed timestamp verified")
+	}
+
+	token, _ = ParseAuthToken(encoded)
+	token.Nonce[0] ^= 1
+	if token.Verify("key") {
+		t.Error("token with changed nonce verified")
+	}
+}
+
+func TestParseAuthTokenMalformed(t *testing.T) {
+	encoded := NewAuthToken("key", time.Now())
+
+	bad := []string{
+		"",
+		encoded[:len(encoded)-1],
+		encoded[:len(encoded)/2],
+		encoded + "AA",
+		strings.Replace(encoded, encoded[:1], "*", 1),
+		encoded + "=",
+	}
+
+	for _, s := range bad {
+		if _, err := ParseAuthToken(s); err == nil {
+			t.Errorf("no error for %#v", s)
+		}
+	}
+}
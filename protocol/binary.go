@@ -0,0 +1,259 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Binary packets are laid out as
+//
+//	version (1 byte) | body length (uvarint) | body
+//
+// The version byte never equals the first byte of protocolMagic, so the
+// reader can tell binary and JSON packets apart.
+const (
+	binaryVersion1 = 0x01
+	maxBinaryLen   = 65536
+)
+
+type Framing int
+
+const (
+	FramingJSON Framing = iota
+	FramingBinary
+)
+
+const (
+	addrTypeIPv4   = 1
+	addrTypeDomain = 3
+	addrTypeIPv6   = 4
+)
+
+// binaryNetworks maps networks to their one-byte codes. Code 0 means the
+// network name follows as a string.
+var binaryNetworks = []string{"", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6"}
+
+func marshalBinary(val interface{}) ([]byte, error) {
+	var body bytes.Buffer
+	switch v := val.(type) {
+	case *ConnectionRequest:
+		if err := marshalRequest(&body, v); err != nil {
+			return nil, err
+		}
+	case *ConnectionResponse:
+		marshalResponse(&body, v)
+	default:
+		return nil, fmt.Errorf("can't marshal %T in binary", val)
+	}
+
+	if body.Len() > maxBinaryLen {
+		return nil, errors.New("binary packet too long")
+	}
+
+	buf := bytes.NewBuffer([]byte{binaryVersion1})
+	putUvarint(buf, uint64(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+func unmarshalBinary(data []byte, val interface{}) error {
+	r := bytes.NewReader(data)
+	var err error
+	switch v := val.(type) {
+	case *ConnectionRequest:
+		err = unmarshalRequest(r, v)
+	case *ConnectionResponse:
+		err = unmarshalResponse(r, v)
+	default:
+		return fmt.Errorf("can't unmarshal %T from binary", val)
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func marshalRequest(buf *bytes.Buffer, req *ConnectionRequest) error {
+	netCode := 0
+	for i, n := range binaryNetworks {
+		if i > 0 && n == req.Network {
+			netCode = i
+		}
+	}
+	buf.WriteByte(byte(netCode))
+	if netCode == 0 {
+		putString(buf, req.Network)
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %#v", portStr)
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		buf.WriteByte(addrTypeIPv4)
+		buf.Write(ip.To4())
+	case ip != nil:
+		buf.WriteByte(addrTypeIPv6)
+		buf.Write(ip.To16())
+	default:
+		if len(host) > 255 {
+			return errors.New("hostname too long")
+		}
+		buf.WriteByte(addrTypeDomain)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+
+	var portBuf [2]byte
+	binary.BigEndian.PutUint16(portBuf[:], uint16(port))
+	buf.Write(portBuf[:])
+
+	putUvarint(buf, uint64(req.Timeout/time.Millisecond))
+	return nil
+}
+
+func unmarshalRequest(r *bytes.Reader, req *ConnectionRequest) error {
+	netCode, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case netCode == 0:
+		if req.Network, err = readString(r); err != nil {
+			return err
+		}
+	case int(netCode) < len(binaryNetworks):
+		req.Network = binaryNetworks[netCode]
+	default:
+		return fmt.Errorf("unknown network code %v", netCode)
+	}
+
+	addrType, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	var host string
+	switch addrType {
+	case addrTypeIPv4, addrTypeIPv6:
+		ip := make(net.IP, 4)
+		if addrType == addrTypeIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return err
+		}
+		host = ip.String()
+
+	case addrTypeDomain:
+		l, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		host = string(name)
+
+	default:
+		return fmt.Errorf("unknown address type %v", addrType)
+	}
+
+	var portBuf [2]byte
+	if _, err := io.ReadFull(r, portBuf[:]); err != nil {
+		return err
+	}
+	port := binary.BigEndian.Uint16(portBuf[:])
+	req.Address = net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	timeout, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	req.Timeout = time.Duration(timeout) * time.Millisecond
+	return nil
+}
+
+func marshalResponse(buf *bytes.Buffer, resp *ConnectionResponse) {
+	putUvarint(buf, uint64(resp.Code))
+	msg := ""
+	if resp.Err != nil {
+		msg = *resp.Err
+	}
+	putString(buf, msg)
+	putString(buf, resp.Padding)
+	if resp.Addr != "" {
+		putString(buf, resp.Addr)
+	}
+}
+
+func unmarshalResponse(r *bytes.Reader, resp *ConnectionResponse) error {
+	code, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	resp.Code = ErrorCode(code)
+
+	msg, err := readString(r)
+	if err != nil {
+		return err
+	}
+	if msg != "" || resp.Code != CodeOK {
+		resp.Err = &msg
+	}
+
+	if resp.Padding, err = readString(r); err != nil {
+		return err
+	}
+
+	// Addr is optional, older peers neither send nor read it.
+	if r.Len() > 0 {
+		resp.Addr, err = readString(r)
+	}
+	return err
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+
+	if l > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
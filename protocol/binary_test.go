@@ -0,0 +1,294 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+var testRequests = []ConnectionRequest{
+	{Network: "tcp", Address: "1.2.3.4:80", Timeout: 30 * time.Second},
+	{Network: "tcp4", Address: "255.255.255.255:65535"},
+	{Network: "tcp6", Address: "[2001:db8::1]:443", Timeout: time.Millisecond},
+	{Network: "udp", Address: "example.com:53", Timeout: time.Hour},
+	{Network: "udp4", Address: "a:1"},
+	{Network: "udp6", Address: "[::1]:0"},
+	{Network: "bind", Address: "0.0.0.0:0", Timeout: 2 * time.Minute},
+	{Network: "", Address: strings.Repeat("x", 255) + ":8080"},
+}
+
+var testResponses = []ConnectionResponse{
+	{},
+	{Padding: strings.Repeat("00", 500)},
+	{Err: strPtr("connection refused"), Code: CodeConnectionRefused},
+	{Err: strPtr(""), Code: CodeTimeout},
+	{Err: strPtr("denied"), Code: CodeNotAllowed, Padding: "ab"},
+	{Addr: "203.0.113.5:41234"},
+	{Addr: "[2001:db8::1]:1", Padding: "00"},
+}
+
+func TestBinaryRequestRoundTrip(t *testing.T) {
+	for _, req := range testRequests {
+		req := req
+		data, err := marshalBinary(&req)
+		if err != nil {
+			t.Fatalf("marshal %+v: %v", req, err)
+		}
+
+		if data[0] != binaryVersion1 {
+			t.Errorf("%+v: version byte %v", req, data[0])
+		}
+
+		got := ConnectionRequest{}
+		if err := unmarshalBinary(data[1+uvarintLen(data[1:]):], &got); err != nil {
+			t.Fatalf("unmarshal %+v: %v", req, err)
+		}
+
+		if !reflect.DeepEqual(got, req) {
+			t.Errorf("round trip: got %+v, want %+v", got, req)
+		}
+	}
+}
+
+func TestBinaryNetworkCodes(t *testing.T) {
+	for i, network := range binaryNetworks[1:] {
+		data, err := marshalBinary(&ConnectionRequest{Network: network, Address: "1.2.3.4:1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// version, length, network code
+		if code := data[2]; int(code) != i+1 {
+			t.Errorf("network %v encoded as %v, want %v", network, code, i+1)
+		}
+	}
+
+	data, err := marshalBinary(&ConnectionRequest{Network: "bind", Address: "1.2.3.4:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[2] != 0 || string(data[4:8]) != "bind" {
+		t.Errorf("unknown network not encoded as a string: %x", data)
+	}
+}
+
+func TestBinaryResponseRoundTrip(t *testing.T) {
+	for _, resp := range testResponses {
+		resp := resp
+		data, err := marshalBinary(&resp)
+		if err != nil {
+			t.Fatalf("marshal %+v: %v", resp, err)
+		}
+
+		got := ConnectionResponse{}
+		if err := unmarshalBinary(data[1+uvarintLen(data[1:]):], &got); err != nil {
+			t.Fatalf("unmarshal %+v: %v", resp, err)
+		}
+
+		if !reflect.DeepEqual(got, resp) {
+			t.Errorf("round trip: got %+v, want %+v", got, resp)
+		}
+	}
+}
+
+func TestBinaryResponseWithoutAddr(t *testing.T) {
+	// Responses of peers not knowing about Addr end right after the padding.
+	var body bytes.Buffer
+	putUvarint(&body, uint64(CodeOK))
+	putString(&body, "")
+	putString(&body, "0000")
+
+	got := ConnectionResponse{}
+	if err := unmarshalBinary(body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, ConnectionResponse{Padding: "0000"}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestBinaryMarshalErrors(t *testing.T) {
+	bad := []ConnectionRequest{
+		{Network: "tcp", Address: "1.2.3.4"},
+		{Network: "tcp", Address: "1.2.3.4:65536"},
+		{Network: "tcp", Address: "1.2.3.4:http"},
+		{Network: "tcp", Address: strings.Repeat("x", 256) + ":80"},
+	}
+
+	for _, req := range bad {
+		req := req
+		if _, err := marshalBinary(&req); err == nil {
+			t.Errorf("marshal %+v: no error", req)
+		}
+	}
+
+	if _, err := marshalBinary(&ClientHello{}); err == nil {
+		t.Error("marshal of unsupported type: no error")
+	}
+
+	huge := ConnectionResponse{Padding: strings.Repeat("0", maxBinaryLen)}
+	if _, err := marshalBinary(&huge); err == nil {
+		t.Error("marshal of too long packet: no error")
+	}
+}
+
+// readFrom runs readPacket over a connection the data is written to.
+func readFrom(data []byte, val interface{}) (Framing, error) {
+	client, server := net.Pipe()
+	go func() {
+		_, _ = client.Write(data)
+		_ = client.Close()
+	}()
+	defer func() { _ = server.Close() }()
+
+	return readPacket(context.Background(), server, val)
+}
+
+func TestFramedPacketRoundTrip(t *testing.T) {
+	for _, framing := range []Framing{FramingJSON, FramingBinary} {
+		for _, req := range testRequests {
+			req := req
+			client, server := net.Pipe()
+			go func() {
+				_ = WriteFramedPacket(context.Background(), client, framing, &req)
+			}()
+
+			got, err := ReadRequest(context.Background(), server)
+			_ = client.Close()
+			_ = server.Close()
+			if err != nil {
+				t.Fatalf("framing %v, %+v: %v", framing, req, err)
+			}
+
+			if got.Framing != framing {
+				t.Errorf("framing %v detected as %v", framing, got.Framing)
+			}
+
+			got.Framing = req.Framing
+			if !reflect.DeepEqual(*got, req) {
+				t.Errorf("framing %v: got %+v, want %+v", framing, *got, req)
+			}
+		}
+	}
+
+	// The hello is only sent in JSON.
+	client, server := net.Pipe()
+	resp := &ConnectionResponse{Hello: &ServerHello{Version: 1, Features: []Feature{FeatureUDP}}}
+	go func() { _ = WritePacket(context.Background(), client, resp) }()
+	got, err := ReadResponse(context.Background(), server)
+	_ = client.Close()
+	_ = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, resp) {
+		t.Errorf("got %+v, want %+v", got, resp)
+	}
+}
+
+func TestReadPacketTruncated(t *testing.T) {
+	var packets [][]byte
+	for _, framing := range []Framing{FramingJSON, FramingBinary} {
+		for _, req := range testRequests {
+			req := req
+			var buf bytes.Buffer
+			client, server := net.Pipe()
+			go func() {
+				_ = WriteFramedPacket(context.Background(), client, framing, &req)
+				_ = client.Close()
+			}()
+			_, _ = buf.ReadFrom(server)
+			packets = append(packets, buf.Bytes())
+		}
+	}
+
+	for _, p := range packets {
+		for i := 0; i < len(p); i++ {
+			if _, err := readFrom(p[:i], &ConnectionRequest{}); err == nil {
+				t.Fatalf("no error for %v of %v bytes of %q", i, len(p), p)
+			}
+		}
+
+		if _, err := readFrom(p, &ConnectionRequest{}); err != nil {
+			t.Fatalf("error for the whole packet %q: %v", p, err)
+		}
+	}
+}
+
+func TestReadPacketOversized(t *testing.T) {
+	binaryPacket := []byte{binaryVersion1}
+	var tmp [binary.MaxVarintLen64]byte
+	binaryPacket = append(binaryPacket, tmp[:binary.PutUvarint(tmp[:], maxBinaryLen+1)]...)
+
+	jsonPacket := []byte(protocolMagic + "\xff\xff\xff\xff")
+
+	overflow := []byte{binaryVersion1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+
+	for _, p := range [][]byte{binaryPacket, jsonPacket, overflow} {
+		if _, err := readFrom(p, &ConnectionRequest{}); err == nil || !strings.Contains(err.Error(), "too long") && !strings.Contains(err.Error(), "overflow") {
+			t.Errorf("packet %x: error %v", p, err)
+		}
+	}
+
+	if _, err := readFrom([]byte("Eldb\x00\x00\x00\x00"), &ConnectionRequest{}); err == nil {
+		t.Error("no error for wrong magic")
+	}
+}
+
+func TestUnmarshalBinaryNeverPanics(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	var seeds [][]byte
+	for _, req := range testRequests {
+		req := req
+		data, _ := marshalBinary(&req)
+		seeds = append(seeds, data[1+uvarintLen(data[1:]):])
+	}
+	for _, resp := range testResponses {
+		resp := resp
+		data, _ := marshalBinary(&resp)
+		seeds = append(seeds, data[1+uvarintLen(data[1:]):])
+	}
+
+	check := func(data []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("panic on %x: %v", data, r)
+			}
+		}()
+		_ = unmarshalBinary(data, &ConnectionRequest{})
+		_ = unmarshalBinary(data, &ConnectionResponse{})
+	}
+
+	for i := 0; i < 20000; i++ {
+		var data []byte
+		if i%2 == 0 {
+			data = make([]byte, rnd.Intn(64))
+			rnd.Read(data)
+		} else {
+			seed := seeds[rnd.Intn(len(seeds))]
+			data = append([]byte(nil), seed...)
+			for j := rnd.Intn(4) + 1; j > 0 && len(data) > 0; j-- {
+				data[rnd.Intn(len(data))] = byte(rnd.Intn(256))
+			}
+			data = data[:rnd.Intn(len(data)+1)]
+		}
+		check(data)
+	}
+}
+
+func uvarintLen(data []byte) int {
+	_, n := binary.Uvarint(data)
+	return n
+}
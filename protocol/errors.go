@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+type ErrorCode int
+
+const (
+	CodeOK ErrorCode = iota
+	CodeGeneralFailure
+	CodeNotAllowed
+	CodeNetworkUnreachable
+	CodeHostUnreachable
+	CodeConnectionRefused
+	CodeTimeout
+	CodeDNSFailure
+	CodeNetworkNotSupported
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeOK:                  "ok",
+	CodeGeneralFailure:      "general failure",
+	CodeNotAllowed:          "not allowed",
+	CodeNetworkUnreachable:  "network unreachable",
+	CodeHostUnreachable:     "host unreachable",
+	CodeConnectionRefused:   "connection refused",
+	CodeTimeout:             "timeout",
+	CodeDNSFailure:          "dns failure",
+	CodeNetworkNotSupported: "network not supported",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error code %d", int(c))
+}
+
+// CodedError is implemented by errors that know their protocol error code.
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+}
+
+// RemoteError is the error reported by the remote end in ConnectionResponse.
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote: %s (%v)", e.Message, e.Code)
+}
+
+func (e *RemoteError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// ErrorResponse builds a response reporting err to the other side.
+func ErrorResponse(err error) *ConnectionResponse {
+	msg := err.Error()
+	return &ConnectionResponse{Err: &msg, Code: ErrorCodeOf(err)}
+}
+
+// ErrorCodeOf maps dial errors to protocol error codes. Errors wrapped with
+// %w are looked through, so a *RemoteError keeps its code.
+func ErrorCodeOf(err error) ErrorCode {
+	var ce CodedError
+	if errors.As(err, &ce) {
+		return ce.ErrorCode()
+	}
+
+	for err != nil {
+		if err == context.DeadlineExceeded {
+			return CodeTimeout
+		}
+
+		switch e := err.(type) {
+		case *net.DNSError:
+			if e.IsTimeout {
+				return CodeTimeout
+			}
+			return CodeDNSFailure
+
+		case *net.OpError:
+			if e.Timeout() {
+				return CodeTimeout
+			}
+			err = e.Err
+
+		case *os.SyscallError:
+			err = e.Err
+
+		case syscall.Errno:
+			switch e {
+			case syscall.ECONNREFUSED:
+				return CodeConnectionRefused
+			case syscall.EHOSTUNREACH, syscall.EHOSTDOWN:
+				return CodeHostUnreachable
+			case syscall.ENETUNREACH, syscall.ENETDOWN:
+				return CodeNetworkUnreachable
+			case syscall.ETIMEDOUT:
+				return CodeTimeout
+			case syscall.EACCES, syscall.EPERM:
+				return CodeNotAllowed
+			}
+			return CodeGeneralFailure
+
+		default:
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return CodeTimeout
+			}
+			if inner := errors.Unwrap(err); inner != nil {
+				err = inner
+				continue
+			}
+			return CodeGeneralFailure
+		}
+	}
+
+	return CodeOK
+}
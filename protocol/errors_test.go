@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	remote := &RemoteError{Message: "no route", Code: CodeHostUnreachable}
+
+	tests := []struct {
+		err  error
+		code ErrorCode
+	}{
+		{nil, CodeOK},
+		{errors.New("boom"), CodeGeneralFailure},
+		{context.DeadlineExceeded, CodeTimeout},
+		{&net.DNSError{Err: "no such host"}, CodeDNSFailure},
+		{refused, CodeConnectionRefused},
+		{remote, CodeHostUnreachable},
+		{fmt.Errorf("dial via upstream: %w", remote), CodeHostUnreachable},
+		{fmt.Errorf("dial: %w", fmt.Errorf("retry: %w", refused)), CodeConnectionRefused},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), CodeTimeout},
+	}
+
+	for _, tt := range tests {
+		if code := ErrorCodeOf(tt.err); code != tt.code {
+			t.Errorf("ErrorCodeOf(%v) = %v, want %v", tt.err, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"time"
+)
+
+const ProtocolVersion = 1
+
+type Feature string
+
+// Features of the protocol. There are none for compression and reverse
+// tunnels yet, as neither is implemented.
+const (
+	FeatureUDP           Feature = "udp"
+	FeatureBinaryFraming Feature = "binary_framing"
+	FeatureObfuscation   Feature = "obfuscation"
+	FeatureNoise         Feature = "noise"
+	FeatureBind          Feature = "bind"
+)
+
+// SupportedFeatures lists the features this implementation can speak.
+var SupportedFeatures = []Feature{
+	FeatureUDP,
+	FeatureBinaryFraming,
+	FeatureObfuscation,
+	FeatureNoise,
+	FeatureBind,
+}
+
+// ClientHello is the first packet the client sends in the tunnel, once per
+// session, after the server offered its features in the initial response. A
+// response without an offer comes from a server that doesn't negotiate, and
+// the client starts the multiplexer right away instead. Likewise, clients
+// without negotiation skip the hello and start with multiplexer frames.
+type ClientHello struct {
+	Version  int
+	Features []Feature
+
+	// Obfuscation asks for the obfuscation layer below the multiplexer.
+	// The client applies it right away, so it must not be set for servers
+	// without FeatureObfuscation.
+	Obfuscation *ObfuscationParams `json:",omitempty"`
+
+	// Noise asks for the encryption layer under the multiplexer. Like
+	// obfuscation, the client turns it on without waiting for the answer.
+	Noise bool `json:",omitempty"`
+}
+
+// ServerHello answers the client hello in a second response. Features holds
+// the negotiated set, i.e. the features both sides support. The offer in the
+// initial response is a ServerHello too, with everything the server supports
+// and no layers turned on.
+type ServerHello struct {
+	Version  int
+	Features []Feature
+	Limits   Limits
+
+	// Obfuscation holds the parameters the server uses for its direction,
+	// nil if the layer is off.
+	Obfuscation *ObfuscationParams `json:",omitempty"`
+
+	// Noise tells that the server runs the encryption layer.
+	Noise bool `json:",omitempty"`
+}
+
+// Limits are imposed by the server on the session. The client lowers its
+// own settings to them.
+type Limits struct {
+	MaxStreamsPerSession int `json:",omitempty"`
+
+	// DialTimeout caps the time the server spends connecting to a remote.
+	DialTimeout time.Duration `json:",omitempty"`
+}
+
+func NewClientHello(features []Feature) *ClientHello {
+	return &ClientHello{Version: ProtocolVersion, Features: features}
+}
+
+// NewServerOffer makes the hello the server sends before the client's one.
+func NewServerOffer(supported []Feature, limits Limits) *ServerHello {
+	return &ServerHello{Version: ProtocolVersion, Features: supported, Limits: limits}
+}
+
+// NewServerHello answers the client hello with the common version and
+// feature set.
+func NewServerHello(client *ClientHello, supported []Feature, limits Limits) *ServerHello {
+	version := ProtocolVersion
+	if client.Version < version {
+		version = client.Version
+	}
+
+	var common []Feature
+	for _, f := range client.Features {
+		if HasFeature(supported, f) {
+			common = append(common, f)
+		}
+	}
+
+	hello := &ServerHello{Version: version, Features: common, Limits: limits}
+	if client.Obfuscation != nil && HasFeature(common, FeatureObfuscation) {
+		params := *client.Obfuscation
+		hello.Obfuscation = &params
+	}
+	hello.Noise = client.Noise && HasFeature(common, FeatureNoise)
+	return hello
+}
+
+func HasFeature(features []Feature, f Feature) bool {
+	for _, feature := range features {
+		if feature == f {
+			return true
+		}
+	}
+	return false
+}
@@ -13,32 +13,59 @@ import (
 
 const protocolMagic = "Elda"
 
+// maxJSONLen limits the length of JSON packets, so a bogus length doesn't
+// make the reader allocate gigabytes.
+const maxJSONLen = 1 << 20
+
 func ReadRequest(ctx context.Context, from net.Conn) (*ConnectionRequest, error) {
 	cr := &ConnectionRequest{}
-	if err := readPacket(ctx, from, cr); err != nil {
+	framing, err := readPacket(ctx, from, cr)
+	if err != nil {
 		return nil, err
 	}
+	cr.Framing = framing
 	return cr, nil
 }
 
 func ReadResponse(ctx context.Context, from net.Conn) (*ConnectionResponse, error) {
 	cr := &ConnectionResponse{}
-	if err := readPacket(ctx, from, cr); err != nil {
+	if _, err := readPacket(ctx, from, cr); err != nil {
 		return nil, err
 	}
 	return cr, nil
 }
 
-func WritePacket(ctx context.Context, to net.Conn, val interface{}) error {
-	buf := bytes.NewBufferString(protocolMagic + "\x00\x00\x00\x00")
-	enc := json.NewEncoder(buf)
-	if err := enc.Encode(val); err != nil {
-		return err
+func ReadClientHello(ctx context.Context, from net.Conn) (*ClientHello, error) {
+	h := &ClientHello{}
+	if _, err := readPacket(ctx, from, h); err != nil {
+		return nil, err
 	}
+	return h, nil
+}
 
-	l := buf.Len() - 8
-	data := buf.Bytes()
-	binary.BigEndian.PutUint32(data[4:8], uint32(l))
+// WritePacket writes val as a JSON packet, which every peer understands.
+func WritePacket(ctx context.Context, to net.Conn, val interface{}) error {
+	return WriteFramedPacket(ctx, to, FramingJSON, val)
+}
+
+func WriteFramedPacket(ctx context.Context, to net.Conn, framing Framing, val interface{}) error {
+	var data []byte
+	if framing == FramingBinary {
+		var err error
+		if data, err = marshalBinary(val); err != nil {
+			return err
+		}
+	} else {
+		buf := bytes.NewBufferString(protocolMagic + "\x00\x00\x00\x00")
+		enc := json.NewEncoder(buf)
+		if err := enc.Encode(val); err != nil {
+			return err
+		}
+
+		l := buf.Len() - 8
+		data = buf.Bytes()
+		binary.BigEndian.PutUint32(data[4:8], uint32(l))
+	}
 
 	var wg sync.WaitGroup
 	newCtx, cancel := context.WithCancel(ctx)
@@ -61,7 +88,7 @@ func WritePacket(ctx context.Context, to net.Conn, val interface{}) error {
 	return err
 }
 
-func readPacket(ctx context.Context, from net.Conn, val interface{}) error {
+func readPacket(ctx context.Context, from net.Conn, val interface{}) (Framing, error) {
 	var wg sync.WaitGroup
 	newCtx, cancel := context.WithCancel(ctx)
 	defer func() { cancel(); wg.Wait() }()
@@ -82,29 +109,69 @@ func readPacket(ctx context.Context, from net.Conn, val interface{}) error {
 		return err
 	}
 
+	var first [1]byte
+	if _, err := io.ReadFull(from, first[:]); err != nil {
+		return 0, checkContext(err)
+	}
+
+	if first[0] == binaryVersion1 {
+		structLen, err := binary.ReadUvarint(byteReader{from})
+		if err != nil {
+			return 0, checkContext(err)
+		}
+
+		if structLen > maxBinaryLen {
+			return 0, errors.New("binary packet too long")
+		}
+
+		data := make([]byte, structLen)
+		if _, err := io.ReadFull(from, data); err != nil {
+			return 0, checkContext(err)
+		}
+
+		return FramingBinary, unmarshalBinary(data, val)
+	}
+
 	var magic [4]byte
-	if _, err := io.ReadFull(from, magic[:]); err != nil {
-		return checkContext(err)
+	magic[0] = first[0]
+	if _, err := io.ReadFull(from, magic[1:]); err != nil {
+		return 0, checkContext(err)
 	}
 
 	if string(magic[:]) != protocolMagic {
-		return errors.New("magic mismatch")
+		return 0, errors.New("magic mismatch")
 	}
 
 	var l [4]byte
 	if _, err := io.ReadFull(from, l[:]); err != nil {
-		return checkContext(err)
+		return 0, checkContext(err)
 	}
 
 	structLen := binary.BigEndian.Uint32(l[:])
+	if structLen > maxJSONLen {
+		return 0, errors.New("json packet too long")
+	}
+
 	data := make([]byte, structLen)
 	if _, err := io.ReadFull(from, data); err != nil {
-		return checkContext(err)
+		return 0, checkContext(err)
 	}
 
 	decoder := json.NewDecoder(bytes.NewReader(data))
 	if err := decoder.Decode(val); err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return FramingJSON, nil
+}
+
+// byteReader reads the connection byte by byte, so nothing past the packet
+// is consumed.
+type byteReader struct {
+	io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(br.Reader, b[:])
+	return b[0], err
 }
@@ -0,0 +1,40 @@
+package protocol
+
+import "time"
+
+// ObfuscationParams configure the obfuscation layer, which hides sizes and
+// timings of the multiplexer frames. Each side uses the parameters for the
+// data it sends.
+type ObfuscationParams struct {
+	// MaxPadding is the upper bound of random padding added to each frame.
+	MaxPadding int `yaml:"max_padding" json:",omitempty"`
+
+	// Buckets are frame sizes, every frame is padded up to the smallest
+	// bucket it fits in. Larger writes are split.
+	Buckets []int `yaml:"buckets" json:",omitempty"`
+
+	// ChaffInterval makes the sender emit dummy frames when it had nothing
+	// to send for about that long.
+	ChaffInterval time.Duration `yaml:"chaff_interval" json:",omitempty"`
+
+	// MaxOverhead limits padding and chaff to this share of the data sent,
+	// e.g. 0.5 allows 50% more bytes on the wire. Zero means no limit.
+	MaxOverhead float64 `yaml:"max_overhead" json:",omitempty"`
+}
+
+// LimitOverhead returns the parameters with MaxOverhead not exceeding max.
+func (p ObfuscationParams) LimitOverhead(max float64) ObfuscationParams {
+	if max > 0 && (p.MaxOverhead == 0 || p.MaxOverhead > max) {
+		p.MaxOverhead = max
+	}
+	return p
+}
+
+// LimitChaff returns the parameters with ChaffInterval not below min, unless
+// chaff is off.
+func (p ObfuscationParams) LimitChaff(min time.Duration) ObfuscationParams {
+	if p.ChaffInterval > 0 && p.ChaffInterval < min {
+		p.ChaffInterval = min
+	}
+	return p
+}
@@ -2,13 +2,46 @@ package protocol
 
 import "time"
 
+// NetworkBind asks the server to listen on a port and relay back the first
+// inbound connection instead of dialing.
+const NetworkBind = "bind"
+
 type ConnectionRequest struct {
 	Network string
 	Address string
 	Timeout time.Duration
+
+	// Framing is the encoding the request was received in; the response is
+	// sent back in the same one.
+	Framing Framing `json:"-"`
 }
 
 type ConnectionResponse struct {
 	Err     *string
+	Code    ErrorCode
 	Padding string
+
+	// Addr is set in the responses to bind requests: the first one holds the
+	// listening address, the second one the address of the accepted peer.
+	Addr string `json:",omitempty"`
+
+	// Hello is set in the initial response if the client sent a hello.
+	Hello *ServerHello `json:",omitempty"`
+}
+
+// Error returns the error reported in the response, if any. Responses from
+// servers not sending error codes are reported as general failures.
+func (r *ConnectionResponse) Error() error {
+	if r.Err == nil && r.Code == CodeOK {
+		return nil
+	}
+
+	e := &RemoteError{Code: r.Code}
+	if r.Err != nil {
+		e.Message = *r.Err
+	}
+	if e.Code == CodeOK {
+		e.Code = CodeGeneralFailure
+	}
+	return e
 }
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/neex/tcp-over-http/common"
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// builtinDenyRules are checked after the configured rules, so loopback,
+// link-local (cloud metadata endpoints), private and multicast ranges stay
+// closed unless explicitly allowed. NAT64 prefixes are closed as well, since
+// on NAT64 hosts they reach any IPv4 address, loopback included.
+var builtinDenyRules = []*ACLRule{
+	{
+		Action: ACLDeny,
+		CIDRs: []string{
+			"0.0.0.0/8", "127.0.0.0/8", "::/128", "::1/128",
+			"169.254.0.0/16", "fe80::/10",
+			"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7",
+			"224.0.0.0/4", "ff00::/8",
+			"64:ff9b::/96", "64:ff9b:1::/48",
+		},
+	},
+}
+
+// lookupIPAddr is replaced in tests.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+func init() {
+	for _, r := range builtinDenyRules {
+		if err := r.compile(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type ACL struct {
+	Rules   []*ACLRule `yaml:"rules"`
+	Default string     `yaml:"default"`
+}
+
+// ACLRule matches a destination if all of its non-empty criteria match.
+// Hosts are glob patterns matched against the hostname requested by the
+// client, CIDRs are matched against the resolved addresses.
+type ACLRule struct {
+	Action   string   `yaml:"action"`
+	Networks []string `yaml:"networks"`
+	CIDRs    []string `yaml:"cidrs"`
+	Hosts    []string `yaml:"hosts"`
+	Ports    []string `yaml:"ports"`
+
+	nets  []*net.IPNet
+	ports []portRange
+}
+
+type portRange struct {
+	from, to int
+}
+
+type DeniedError struct {
+	Address string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("destination %s denied by policy", e.Address)
+}
+
+func (e *DeniedError) ErrorCode() protocol.ErrorCode {
+	return protocol.CodeNotAllowed
+}
+
+func (a *ACL) compile() error {
+	switch a.Default {
+	case "":
+		a.Default = ACLAllow
+	case ACLAllow, ACLDeny:
+	default:
+		return fmt.Errorf("invalid acl default action %#v", a.Default)
+	}
+
+	for _, r := range a.Rules {
+		if err := r.compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Allowed checks whether the client may connect to ip:port over network.
+// The host is the name the client asked for (equal to the ip string if the
+// client asked for an address).
+func (a *ACL) Allowed(network, host string, ip net.IP, port int) bool {
+	for _, rules := range [][]*ACLRule{a.Rules, builtinDenyRules} {
+		for _, r := range rules {
+			if r.matches(network, host, ip, port) {
+				return r.Action == ACLAllow
+			}
+		}
+	}
+
+	return a.Default == ACLAllow
+}
+
+// ACLDialMiddleware resolves the address, checks every resolved IP against
+// the acl and dials the allowed ones only. Dialing the resolved IP rather
+// than the name prevents the check from being bypassed via DNS.
+func ACLDialMiddleware(acl *ACL, next common.DialContextFunc) common.DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := net.DefaultResolver.LookupPort(ctx, network, portStr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := resolve(ctx, network, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error = &DeniedError{Address: address}
+		for _, ip := range ips {
+			if !acl.Allowed(network, host, ip, port) {
+				continue
+			}
+
+			conn, err := next(ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+
+		return nil, lastErr
+	}
+}
+
+func resolve(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		isV4 := addr.IP.To4() != nil
+		if strings.HasSuffix(network, "4") && !isV4 || strings.HasSuffix(network, "6") && isV4 {
+			continue
+		}
+		ips = append(ips, addr.IP)
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no suitable address found for %s", host)
+	}
+
+	return ips, nil
+}
+
+func (r *ACLRule) compile() error {
+	if r.Action != ACLAllow && r.Action != ACLDeny {
+		return fmt.Errorf("invalid acl action %#v", r.Action)
+	}
+
+	r.nets = nil
+	for _, cidr := range r.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+
+	r.ports = nil
+	for _, p := range r.Ports {
+		var pr portRange
+		var err error
+		if idx := strings.IndexByte(p, '-'); idx != -1 {
+			pr.from, err = strconv.Atoi(p[:idx])
+			if err == nil {
+				pr.to, err = strconv.Atoi(p[idx+1:])
+			}
+		} else {
+			pr.from, err = strconv.Atoi(p)
+			pr.to = pr.from
+		}
+
+		if err != nil || pr.from > pr.to {
+			return fmt.Errorf("invalid acl port range %#v", p)
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	for _, h := range r.Hosts {
+		if _, err := path.Match(h, ""); err != nil {
+			return fmt.Errorf("invalid acl host pattern %#v", h)
+		}
+	}
+
+	return nil
+}
+
+func (r *ACLRule) matches(network, host string, ip net.IP, port int) bool {
+	if len(r.Networks) > 0 {
+		found := false
+		for _, n := range r.Networks {
+			if n == network || n == strings.TrimRight(network, "46") {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Hosts) > 0 {
+		// "internal.corp." is the same name as "internal.corp".
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		found := false
+		for _, h := range r.Hosts {
+			if ok, _ := path.Match(strings.ToLower(strings.TrimSuffix(h, ".")), host); ok {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.nets) > 0 {
+		found := false
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 {
+		found := false
+		for _, pr := range r.ports {
+			if port >= pr.from && port <= pr.to {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
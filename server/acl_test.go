@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustCompile(t *testing.T, acl *ACL) *ACL {
+	t.Helper()
+	if err := acl.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	return acl
+}
+
+func TestACLAllowed(t *testing.T) {
+	acl := mustCompile(t, &ACL{
+		Default: ACLAllow,
+		Rules: []*ACLRule{
+			{Action: ACLDeny, Ports: []string{"25"}},
+			{Action: ACLAllow, Networks: []string{"tcp"}, CIDRs: []string{"10.1.2.0/24"}, Ports: []string{"80", "8000-8999"}},
+			{Action: ACLDeny, Hosts: []string{"*.internal.example.com"}},
+			{Action: ACLDeny, Hosts: []string{"*.corp"}},
+			{Action: ACLDeny, Networks: []string{"udp"}, CIDRs: []string{"8.8.8.8/32"}},
+		},
+	})
+
+	tests := []struct {
+		network, host, ip string
+		port              int
+		allowed           bool
+	}{
+		{"tcp", "1.1.1.1", "1.1.1.1", 443, true},
+		{"tcp", "1.1.1.1", "1.1.1.1", 25, false},
+		{"tcp", "10.1.2.3", "10.1.2.3", 80, true},
+		{"tcp4", "10.1.2.3", "10.1.2.3", 8500, true},
+		{"tcp", "10.1.2.3", "10.1.2.3", 9000, false},
+		{"udp", "10.1.2.3", "10.1.2.3", 80, false},
+		{"tcp", "db.internal.example.com", "1.2.3.4", 443, false},
+		{"tcp", "DB.Internal.Example.com", "1.2.3.4", 443, false},
+		{"tcp", "internal.example.com", "1.2.3.4", 443, true},
+		{"tcp", "db.internal.example.com.", "1.2.3.4", 443, false},
+		{"tcp", "internal.corp.", "1.2.3.4", 443, false},
+		{"udp", "8.8.8.8", "8.8.8.8", 53, false},
+		{"tcp", "8.8.8.8", "8.8.8.8", 53, true},
+		{"udp6", "dns", "8.8.8.8", 53, false},
+	}
+
+	for _, tt := range tests {
+		got := acl.Allowed(tt.network, tt.host, net.ParseIP(tt.ip), tt.port)
+		if got != tt.allowed {
+			t.Errorf("Allowed(%v, %v, %v, %v) = %v, want %v", tt.network, tt.host, tt.ip, tt.port, got, tt.allowed)
+		}
+	}
+}
+
+func TestACLBuiltinDeny(t *testing.T) {
+	open := mustCompile(t, &ACL{Default: ACLAllow})
+
+	denied := []string{
+		"127.0.0.1", "0.0.0.0", "::1", "::", "::ffff:127.0.0.1",
+		"169.254.169.254", "fe80::1",
+		"10.0.0.1", "172.16.0.1", "192.168.1.1", "100.64.0.1", "fd00::1",
+		"224.0.0.1", "239.255.255.250", "ff02::1",
+		"64:ff9b::7f00:1", "64:ff9b::a9fe:a9fe", "64:ff9b:1::1",
+	}
+	for _, ip := range denied {
+		if open.Allowed("tcp", ip, net.ParseIP(ip), 80) {
+			t.Errorf("%v is allowed by default", ip)
+		}
+	}
+
+	allowed := []string{"1.1.1.1", "2606:4700:4700::1111", "64:ff9c::1"}
+	for _, ip := range allowed {
+		if !open.Allowed("tcp", ip, net.ParseIP(ip), 80) {
+			t.Errorf("%v is denied by default", ip)
+		}
+	}
+
+	explicit := mustCompile(t, &ACL{
+		Default: ACLDeny,
+		Rules:   []*ACLRule{{Action: ACLAllow, CIDRs: []string{"127.0.0.1/32"}}},
+	})
+	if !explicit.Allowed("tcp", "127.0.0.1", net.ParseIP("127.0.0.1"), 80) {
+		t.Error("explicit rule doesn't override builtin deny")
+	}
+	if explicit.Allowed("tcp", "1.1.1.1", net.ParseIP("1.1.1.1"), 80) {
+		t.Error("default deny isn't applied")
+	}
+}
+
+func TestACLRuleCompile(t *testing.T) {
+	tests := []struct {
+		rule  ACLRule
+		ports []portRange
+		ok    bool
+	}{
+		{ACLRule{Action: ACLAllow, Ports: []string{"80"}}, []portRange{{80, 80}}, true},
+		{ACLRule{Action: ACLAllow, Ports: []string{"1-1024", "8080"}}, []portRange{{1, 1024}, {8080, 8080}}, true},
+		{ACLRule{Action: ACLAllow, Ports: []string{"1024-1"}}, nil, false},
+		{ACLRule{Action: ACLAllow, Ports: []string{"http"}}, nil, false},
+		{ACLRule{Action: ACLAllow, Ports: []string{"1-"}}, nil, false},
+		{ACLRule{Action: ACLAllow, CIDRs: []string{"10.0.0.0/8", "fc00::/7"}}, nil, true},
+		{ACLRule{Action: ACLAllow, CIDRs: []string{"10.0.0.0"}}, nil, false},
+		{ACLRule{Action: ACLAllow, CIDRs: []string{"10.0.0.0/33"}}, nil, false},
+		{ACLRule{Action: ACLAllow, Hosts: []string{"[a-"}}, nil, false},
+		{ACLRule{Action: "permit"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		r := tt.rule
+		err := r.compile()
+		if (err == nil) != tt.ok {
+			t.Errorf("compile(%+v) error = %v, want ok %v", tt.rule, err, tt.ok)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(r.ports, tt.ports) {
+			t.Errorf("compile(%+v) ports = %v, want %v", tt.rule, r.ports, tt.ports)
+		}
+	}
+
+	if err := (&ACL{Default: "maybe"}).compile(); err == nil {
+		t.Error("invalid default action accepted")
+	}
+}
+
+func TestACLDialMiddleware(t *testing.T) {
+	defer func(orig func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = orig }(lookupIPAddr)
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "mixed.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("1.1.1.1")}, {IP: net.ParseIP("2606:4700::1")}}, nil
+		case "rebind.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("169.254.169.254")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	errRefused := errors.New("refused")
+	acl := mustCompile(t, &ACL{Default: ACLAllow})
+
+	tests := []struct {
+		network, address string
+		refuse           map[string]bool
+		dialed           []string
+		denied           bool
+	}{
+		{"tcp", "mixed.example.com:80", nil, []string{"1.1.1.1:80"}, false},
+		{"tcp", "mixed.example.com:80", map[string]bool{"1.1.1.1:80": true}, []string{"1.1.1.1:80", "[2606:4700::1]:80"}, false},
+		{"tcp6", "mixed.example.com:80", nil, []string{"[2606:4700::1]:80"}, false},
+		{"tcp4", "mixed.example.com:https", nil, []string{"1.1.1.1:443"}, false},
+		{"tcp", "rebind.example.com:80", nil, nil, true},
+		{"tcp", "127.0.0.1:80", nil, nil, true},
+		{"tcp", "[64:ff9b::7f00:1]:80", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		var dialed []string
+		next := func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if tt.refuse[address] {
+				return nil, errRefused
+			}
+			c1, c2 := net.Pipe()
+			_ = c2.Close()
+			return c1, nil
+		}
+
+		conn, err := ACLDialMiddleware(acl, next)(context.Background(), tt.network, tt.address)
+		if conn != nil {
+			_ = conn.Close()
+		}
+
+		if !reflect.DeepEqual(dialed, tt.dialed) {
+			t.Errorf("%v %v: dialed %v, want %v", tt.network, tt.address, dialed, tt.dialed)
+		}
+
+		_, isDenied := err.(*DeniedError)
+		if isDenied != tt.denied {
+			t.Errorf("%v %v: error %v, want denied %v", tt.network, tt.address, err, tt.denied)
+		}
+	}
+}
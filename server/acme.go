@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig enables automatic certificates. DirectoryURL and DirectoryCA
+// allow using a CA other than Let's Encrypt, e.g. a local Pebble instance.
+type ACMEConfig struct {
+	Email        string        `yaml:"email"`
+	CacheDir     string        `yaml:"cache_dir"`
+	Domains      []string      `yaml:"domains"`
+	DirectoryURL string        `yaml:"directory_url"`
+	DirectoryCA  string        `yaml:"directory_ca"`
+	RenewBefore  time.Duration `yaml:"renew_before"`
+}
+
+func newACMEManager(cfg *ACMEConfig, vhostDomains []string) (*autocert.Manager, error) {
+	if cfg.CacheDir == "" {
+		return nil, errors.New("acme cache_dir is required")
+	}
+
+	// Challenges and handshakes for names other than virtual hosts never
+	// reach the manager, so certificates couldn't be issued for them.
+	for _, d := range cfg.Domains {
+		if !containsFold(vhostDomains, d) {
+			return nil, fmt.Errorf("acme domain %#v is not a virtual host without a certificate", d)
+		}
+	}
+
+	domains := cfg.Domains
+	if len(domains) == 0 {
+		domains = vhostDomains
+	}
+
+	if len(domains) == 0 {
+		return nil, errors.New("no domains for acme configured")
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.DirectoryCA != "" {
+		pem, err := ioutil.ReadFile(cfg.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in acme directory_ca")
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		RenewBefore: cfg.RenewBefore,
+		Email:       cfg.Email,
+		Client:      client,
+	}, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
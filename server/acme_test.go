@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acmeStandIn is a minimal RFC 8555 CA. It offers http-01 only and checks
+// the challenge by requesting it from validate, as a CA would over the
+// network. Signatures aren't checked.
+type acmeStandIn struct {
+	t        *testing.T
+	validate http.Handler
+
+	m          sync.Mutex
+	srv        *httptest.Server
+	thumbprint string
+	domain     string
+	token      string
+	authzValid bool
+	csr        *x509.CertificateRequest
+	validated  []string
+}
+
+func newACMEStandIn(t *testing.T, validate http.Handler) *acmeStandIn {
+	a := &acmeStandIn{t: t, validate: validate, token: "token123"}
+	a.srv = httptest.NewServer(http.HandlerFunc(a.serve))
+	return a
+}
+
+func (a *acmeStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	url := a.srv.URL
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", time.Now().UnixNano()))
+	if r.URL.Path == "/dir" {
+		writeJSON(w, 200, map[string]string{
+			"newNonce":   url + "/nonce",
+			"newAccount": url + "/account",
+			"newOrder":   url + "/order",
+			"revokeCert": url + "/revoke",
+			"keyChange":  url + "/key-change",
+		})
+		return
+	}
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		a.t.Errorf("acme request to %v: %v", r.URL.Path, err)
+		w.WriteHeader(400)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	order := func(status int) {
+		o := map[string]interface{}{
+			"status":         "pending",
+			"identifiers":    []map[string]string{{"type": "dns", "value": a.domain}},
+			"authorizations": []string{url + "/authz"},
+			"finalize":       url + "/finalize",
+		}
+		if a.authzValid {
+			o["status"] = "ready"
+		}
+		if a.csr != nil {
+			o["status"] = "valid"
+			o["certificate"] = url + "/cert"
+		}
+		w.Header().Set("Location", url+"/order/1")
+		writeJSON(w, status, o)
+	}
+
+	switch r.URL.Path {
+	case "/account":
+		protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		var header struct {
+			JWK struct{ Crv, Kty, X, Y string }
+		}
+		_ = json.Unmarshal(protected, &header)
+		canonical := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, header.JWK.Crv, header.JWK.Kty, header.JWK.X, header.JWK.Y)
+		sum := sha256.Sum256([]byte(canonical))
+		a.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+
+		w.Header().Set("Location", url+"/account/1")
+		writeJSON(w, 201, map[string]string{"status": "valid"})
+
+	case "/order":
+		var req struct{ Identifiers []struct{ Value string } }
+		_ = json.Unmarshal(payload, &req)
+		a.domain = req.Identifiers[0].Value
+		order(201)
+
+	case "/order/1":
+		order(200)
+
+	case "/authz":
+		status := "pending"
+		if a.authzValid {
+			status = "valid"
+		}
+		writeJSON(w, 200, map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": a.domain},
+			"challenges": []map[string]string{{"type": "http-01", "url": url + "/chal", "token": a.token, "status": status}},
+		})
+
+	case "/chal":
+		req := httptest.NewRequest("GET", "http://"+a.domain+"/.well-known/acme-challenge/"+a.token, nil)
+		rec := httptest.NewRecorder()
+		a.validate.ServeHTTP(rec, req)
+		a.validated = append(a.validated, a.domain)
+
+		status := "invalid"
+		if rec.Code == 200 && rec.Body.String() == a.token+"."+a.thumbprint {
+			status = "valid"
+			a.authzValid = true
+		}
+		writeJSON(w, 200, map[string]string{"type": "http-01", "url": url + "/chal", "token": a.token, "status": status})
+
+	case "/finalize":
+		var req struct{ CSR string }
+		_ = json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			a.t.Errorf("finalize: %v", err)
+			w.WriteHeader(400)
+			return
+		}
+		a.csr = csr
+		order(200)
+
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: a.issue()})
+
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func (a *acmeStandIn) issue() []byte {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: a.csr.DNSNames[0]},
+		DNSNames:     a.csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, a.csr.PublicKey, caKey)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return der
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestACMEIssuesForVirtualHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	config := &Config{
+		VirtualHosts: []*VirtualHost{{Domain: "site.example.com", StaticDir: dir}},
+		ACME:         &ACMEConfig{CacheDir: dir, Domains: []string{"Site.example.com"}},
+	}
+	if err := config.setupVirtualHosts(); err != nil {
+		t.Fatal(err)
+	}
+
+	var handler http.Handler = http.NotFoundHandler()
+	ca := newACMEStandIn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	defer ca.srv.Close()
+
+	config.ACME.DirectoryURL = ca.srv.URL + "/dir"
+	config.ACMEManager, err = newACMEManager(config.ACME, config.virtualHostDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = redirectorHandler(config)
+
+	cert, err := config.getCertificate(&tls.ClientHelloInfo{ServerName: "site.example.com"})
+	if err != nil {
+		t.Fatalf("getCertificate: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("site.example.com"); err != nil {
+		t.Error(err)
+	}
+
+	ca.m.Lock()
+	defer ca.m.Unlock()
+	if strings.Join(ca.validated, ",") != "site.example.com" {
+		t.Errorf("challenges validated for %v", ca.validated)
+	}
+}
+
+func TestACMEDomainsMustBeVirtualHosts(t *testing.T) {
+	tests := []struct {
+		domains []string
+		ok      bool
+	}{
+		{nil, true},
+		{[]string{"site.example.com"}, true},
+		{[]string{"SITE.example.com"}, true},
+		{[]string{"other.example.com"}, false},
+		{[]string{"site.example.com", "www.example.com"}, false},
+		{[]string{"pinned.example.com"}, false},
+	}
+
+	vhostDomains := []string{"site.example.com"}
+	for _, tt := range tests {
+		cfg := &ACMEConfig{CacheDir: "/nonexistent", Domains: tt.domains}
+		if _, err := newACMEManager(cfg, vhostDomains); (err == nil) != tt.ok {
+			t.Errorf("domains %v: error %v, want ok %v", tt.domains, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+const defaultAuthWindow = 2 * time.Minute
+
+var (
+	errAuthExpired  = errors.New("auth token expired")
+	errAuthKey      = errors.New("auth token signed by unknown key")
+	errAuthReplayed = errors.New("auth token replayed")
+)
+
+// ReplayCache remembers nonces of auth tokens until the tokens expire.
+type ReplayCache struct {
+	m         sync.Mutex
+	seen      map[string]time.Time
+	lastPurge time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time)}
+}
+
+// Add records the nonce and reports whether it wasn't seen before.
+func (rc *ReplayCache) Add(nonce []byte, expires time.Time) bool {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	now := time.Now()
+	if now.Sub(rc.lastPurge) > time.Minute {
+		for n, exp := range rc.seen {
+			if now.After(exp) {
+				delete(rc.seen, n)
+			}
+		}
+		rc.lastPurge = now
+	}
+
+	if _, ok := rc.seen[string(nonce)]; ok {
+		return false
+	}
+	rc.seen[string(nonce)] = expires
+	return true
+}
+
+// authenticateRequest checks the auth token carried in a cookie or header.
+// A request without the token gets neither user nor error.
+func (c *Config) authenticateRequest(r *http.Request) (*User, error) {
+	var value string
+	if c.AuthHeader != "" {
+		value = r.Header.Get(c.AuthHeader)
+	} else if cookie, err := r.Cookie(c.AuthCookie); err == nil {
+		value = cookie.Value
+	}
+
+	if value == "" {
+		return nil, nil
+	}
+
+	token, err := protocol.ParseAuthToken(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if d := time.Since(token.Timestamp); d > c.AuthWindow || d < -c.AuthWindow {
+		return nil, errAuthExpired
+	}
+
+	user := c.Registry.AuthenticateKey(token)
+	if user == nil {
+		return nil, errAuthKey
+	}
+
+	// Tokens from the future stay valid for longer.
+	if !c.Replays.Add(token.Nonce, token.Timestamp.Add(c.AuthWindow)) {
+		return nil, errAuthReplayed
+	}
+
+	return user, nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+func testAuthConfig() *Config {
+	alice := &User{Name: "alice", Key: "alice key"}
+	bob := &User{Name: "bob", Key: "bob key", Disabled: true}
+	return &Config{
+		AuthCookie: protocol.DefaultAuthCookie,
+		AuthWindow: defaultAuthWindow,
+		Registry:   NewUserRegistry([]*User{alice, bob}),
+		Replays:    NewReplayCache(),
+	}
+}
+
+func requestWithCookie(name, value string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: name, Value: value})
+	return r
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	cfg := testAuthConfig()
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+		user  string
+		err   error
+	}{
+		{"valid", protocol.NewAuthToken("alice key", now), "alice", nil},
+		{"slightly old", protocol.NewAuthToken("alice key", now.Add(-time.Minute)), "alice", nil},
+		{"slightly ahead", protocol.NewAuthToken("alice key", now.Add(time.Minute)), "alice", nil},
+		{"expired", protocol.NewAuthToken("alice key", now.Add(-defaultAuthWindow-time.Second)), "", errAuthExpired},
+		{"far future", protocol.NewAuthToken("alice key", now.Add(defaultAuthWindow+time.Second)), "", errAuthExpired},
+		{"wrong key", protocol.NewAuthToken("mallory key", now), "", errAuthKey},
+		{"disabled user", protocol.NewAuthToken("bob key", now), "", errAuthKey},
+	}
+
+	for _, tt := range tests {
+		user, err := cfg.authenticateRequest(requestWithCookie(cfg.AuthCookie, tt.token))
+		if err != tt.err {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+		}
+
+		name := ""
+		if user != nil {
+			name = user.Name
+		}
+		if name != tt.user {
+			t.Errorf("%v: user %#v, want %#v", tt.name, name, tt.user)
+		}
+	}
+}
+
+func TestAuthenticateRequestReplay(t *testing.T) {
+	cfg := testAuthConfig()
+	token := protocol.NewAuthToken("alice key", time.Now())
+
+	if user, err := cfg.authenticateRequest(requestWithCookie(cfg.AuthCookie, token)); user == nil || err != nil {
+		t.Fatalf("first use: user %v, error %v", user, err)
+	}
+
+	if user, err := cfg.authenticateRequest(requestWithCookie(cfg.AuthCookie, token)); user != nil || err != errAuthReplayed {
+		t.Fatalf("replay: user %v, error %v", user, err)
+	}
+
+	// A token rejected for its key doesn't burn the nonce of a valid one.
+	other := protocol.NewAuthToken("alice key", time.Now())
+	if user, err := cfg.authenticateRequest(requestWithCookie(cfg.AuthCookie, other)); user == nil || err != nil {
+		t.Fatalf("another token: user %v, error %v", user, err)
+	}
+}
+
+func TestAuthenticateRequestMalformed(t *testing.T) {
+	cfg := testAuthConfig()
+	token := protocol.NewAuthToken("alice key", time.Now())
+
+	for _, value := range []string{token[:len(token)-1], token[:10], "garbage", token + "A"} {
+		user, err := cfg.authenticateRequest(requestWithCookie(cfg.AuthCookie, value))
+		if user != nil || err == nil {
+			t.Errorf("cookie %#v: user %v, error %v", value, user, err)
+		}
+	}
+
+	// The token is the only thing that counts.
+	if user, err := cfg.authenticateRequest(requestWithCookie("other", token)); user != nil || err != nil {
+		t.Errorf("other cookie: user %v, error %v", user, err)
+	}
+
+	if user, err := cfg.authenticateRequest(httptest.NewRequest("GET", "/", nil)); user != nil || err != nil {
+		t.Errorf("no cookie: user %v, error %v", user, err)
+	}
+}
+
+func TestAuthenticateRequestHeader(t *testing.T) {
+	cfg := testAuthConfig()
+	cfg.AuthHeader = "X-Token"
+
+	r := requestWithCookie(cfg.AuthCookie, protocol.NewAuthToken("alice key", time.Now()))
+	if user, err := cfg.authenticateRequest(r); user != nil || err != nil {
+		t.Errorf("cookie used with auth_header set: user %v, error %v", user, err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Token", protocol.NewAuthToken("alice key", time.Now()))
+	if user, err := cfg.authenticateRequest(r); user == nil || err != nil {
+		t.Errorf("header: user %v, error %v", user, err)
+	}
+}
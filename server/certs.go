@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, e.g. after a certbot renewal.
+const certCheckInterval = time.Minute
+
+// CertReloader serves a certificate from files that may be replaced while the
+// server runs. New handshakes get the new certificate, established
+// connections are not affected.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+
+	m       sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	cr := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate again. On error, the old one is kept.
+func (cr *CertReloader) Reload() error {
+	modTime := cr.lastModified()
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.m.RLock()
+	defer cr.m.RUnlock()
+	return cr.cert, nil
+}
+
+// Watch reloads the certificate whenever the files change. It never returns.
+func (cr *CertReloader) Watch() {
+	for range time.Tick(certCheckInterval) {
+		cr.m.RLock()
+		changed := cr.lastModified().After(cr.modTime)
+		cr.m.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		l := log.WithField("cert_path", cr.certPath)
+		if err := cr.Reload(); err != nil {
+			l.WithError(err).Error("reloading certificate")
+			continue
+		}
+		l.Info("certificate reloaded")
+	}
+}
+
+func (cr *CertReloader) lastModified() time.Time {
+	var latest time.Time
+	for _, name := range []string{cr.certPath, cr.keyPath} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
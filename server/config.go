@@ -1,51 +1,279 @@
 package server
 
 import (
-	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/flynn/noise"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/yaml.v2"
+
+	"github.com/neex/tcp-over-http/protocol"
+	"github.com/neex/tcp-over-http/transport"
 )
 
 type Config struct {
-	ListenAddr     string        `yaml:"listen_addr"`
-	Token          string        `yaml:"token"`
-	StaticDir      string        `yaml:"static_dir"`
-	Domain         string        `yaml:"domain"`
-	CertPath       string        `yaml:"cert_path"`
-	KeyPath        string        `yaml:"key_path"`
-	RedirectorAddr string        `yaml:"redirector_addr"`
-	DialTimeout    time.Duration `yaml:"dial_timeout"`
+	ListenAddr          string         `yaml:"listen_addr"`
+	Token               string         `yaml:"token"`
+	Users               []*User        `yaml:"users"`
+	KillRevokedSessions bool           `yaml:"kill_revoked_sessions"`
+	AuthCookie          string         `yaml:"auth_cookie"`
+	AuthHeader          string         `yaml:"auth_header"`
+	AuthWindow          time.Duration  `yaml:"auth_window"`
+	ClientCA            string         `yaml:"client_ca"`
+	RequireClientCert   bool           `yaml:"require_client_cert"`
+	StaticDir           string         `yaml:"static_dir"`
+	Upstream            string         `yaml:"upstream"`
+	PreserveHost        bool           `yaml:"preserve_host"`
+	Domain              string         `yaml:"domain"`
+	CertPath            string         `yaml:"cert_path"`
+	KeyPath             string         `yaml:"key_path"`
+	ACME                *ACMEConfig    `yaml:"acme"`
+	VirtualHosts        []*VirtualHost `yaml:"virtual_hosts"`
+	DefaultHost         string         `yaml:"default_host"`
+	RedirectorAddr      string         `yaml:"redirector_addr"`
+	DialTimeout         time.Duration  `yaml:"dial_timeout"`
+	ACL                 *ACL           `yaml:"acl"`
+	MaxStreams          int            `yaml:"max_streams_per_session"`
+
+	MaxObfuscationOverhead float64       `yaml:"max_obfuscation_overhead"`
+	MinChaffInterval       time.Duration `yaml:"min_chaff_interval"`
+	NoisePrivateKey        string        `yaml:"noise_private_key"`
+	BindAddress            string        `yaml:"bind_address"`
 
-	Certificate tls.Certificate `yaml:"-"`
+	ACMEManager *autocert.Manager `yaml:"-"`
+	ClientCAs   *x509.CertPool    `yaml:"-"`
+	Registry    *UserRegistry     `yaml:"-"`
+	Replays     *ReplayCache      `yaml:"-"`
+	NoiseKey    *noise.DHKey      `yaml:"-"`
+
+	// m guards ACL, which is replaced on reload.
+	m   sync.Mutex
+	raw map[string]interface{}
 }
 
 func NewConfigFromFile(filename string) (*Config, error) {
-	f, err := os.Open(filename)
+	cfg, err := readConfigFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = f.Close() }()
-	dec := yaml.NewDecoder(f)
-	cfg := &Config{}
-	if err := dec.Decode(cfg); err != nil {
+
+	if cfg.ACME != nil && cfg.CertPath != "" {
+		return nil, errors.New("acme and cert_path can't be used together")
+	}
+
+	if err := cfg.setupVirtualHosts(); err != nil {
 		return nil, err
 	}
 
+	if cfg.ACME != nil {
+		cfg.ACMEManager, err = newACMEManager(cfg.ACME, cfg.virtualHostDomains())
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if !cfg.IsHTTPS() {
 		log.Warn("serving without https")
-	} else {
-		cfg.Certificate, err = tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+	}
+
+	if cfg.ClientCA != "" {
+		if !cfg.IsHTTPS() {
+			return nil, errors.New("client_ca requires https")
+		}
+
+		pem, err := ioutil.ReadFile(cfg.ClientCA)
 		if err != nil {
 			return nil, err
 		}
+
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", cfg.ClientCA)
+		}
+	}
+
+	if cfg.BindAddress != "" && net.ParseIP(cfg.BindAddress) == nil {
+		return nil, fmt.Errorf("bind_address %#v is not an IP address", cfg.BindAddress)
 	}
 
+	if cfg.NoisePrivateKey != "" {
+		key, err := transport.NoiseKeyFromPrivate(cfg.NoisePrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.NoiseKey = &key
+	}
+
+	if cfg.AuthCookie == "" {
+		cfg.AuthCookie = protocol.DefaultAuthCookie
+	}
+
+	if cfg.AuthWindow == 0 {
+		cfg.AuthWindow = defaultAuthWindow
+	}
+
+	// A negative overhead cap lifts it.
+	if cfg.MaxObfuscationOverhead == 0 {
+		cfg.MaxObfuscationOverhead = defaultMaxObfuscationOverhead
+	}
+
+	if cfg.MinChaffInterval == 0 {
+		cfg.MinChaffInterval = defaultMinChaffInterval
+	}
+
+	if cfg.raw, err = readRawConfig(filename); err != nil {
+		return nil, err
+	}
+
+	cfg.Registry = NewUserRegistry(cfg.Users)
+	cfg.Replays = NewReplayCache()
 	return cfg, nil
 }
 
+// reloadableSettings are the top-level keys of the config file Reload
+// applies to the running server.
+var reloadableSettings = map[string]bool{
+	"users":                 true,
+	"token":                 true,
+	"kill_revoked_sessions": true,
+	"acl":                   true,
+}
+
+// Reload re-reads the users and the ACL from the config file and applies them
+// to the running server. The other settings can't be changed without a
+// restart; the ones that differ from the running config are returned.
+func (c *Config) Reload(filename string) (needRestart []string, err error) {
+	cfg, err := readConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := readRawConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Registry.Update(cfg.Users, cfg.KillRevokedSessions)
+
+	c.m.Lock()
+	c.ACL = cfg.ACL
+	needRestart = changedSettings(c.raw, raw)
+	c.m.Unlock()
+
+	return needRestart, nil
+}
+
+// CurrentACL returns the server-wide ACL, which may be replaced by Reload.
+func (c *Config) CurrentACL() *ACL {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.ACL
+}
+
+func changedSettings(old, new map[string]interface{}) []string {
+	var changed []string
+	for k, v := range new {
+		if !reloadableSettings[k] && !reflect.DeepEqual(old[k], v) {
+			changed = append(changed, k)
+		}
+	}
+
+	for k := range old {
+		if _, ok := new[k]; !ok && !reloadableSettings[k] {
+			changed = append(changed, k)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+func readRawConfig(filename string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// ReloadCertificates re-reads the certificate files of all virtual hosts.
+func (c *Config) ReloadCertificates() error {
+	for _, vh := range c.VirtualHosts {
+		if vh.Certificate == nil {
+			continue
+		}
+
+		if err := vh.Certificate.Reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchCertificates starts reloading certificates when their files change.
+func (c *Config) WatchCertificates() {
+	for _, vh := range c.VirtualHosts {
+		if vh.Certificate != nil {
+			go vh.Certificate.Watch()
+		}
+	}
+}
+
 func (c *Config) IsHTTPS() bool {
-	return c.CertPath != ""
+	if c.CertPath != "" || c.ACME != nil {
+		return true
+	}
+
+	for _, vh := range c.VirtualHosts {
+		if vh.CertPath != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func readConfigFile(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	dec := yaml.NewDecoder(f)
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Token != "" {
+		cfg.Users = append(cfg.Users, &User{Name: "default", Token: cfg.Token})
+	}
+
+	if err := validateUsers(cfg.Users); err != nil {
+		return nil, err
+	}
+
+	if cfg.ACL == nil {
+		cfg.ACL = &ACL{}
+	}
+
+	if err := cfg.ACL.compile(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
 }
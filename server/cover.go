@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// newCoverHandler makes the handler for everything but tunnel requests:
+// either static files or a reverse proxy to a real website.
+func newCoverHandler(vh *VirtualHost) (http.Handler, error) {
+	if vh.Upstream == "" {
+		return http.FileServer(http.Dir(vh.StaticDir)), nil
+	}
+
+	if vh.StaticDir != "" {
+		return nil, fmt.Errorf("virtual host %#v has both static_dir and upstream", vh.Domain)
+	}
+
+	target, err := url.Parse(vh.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported upstream %#v", vh.Upstream)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		if !vh.PreserveHost {
+			r.Host = target.Host
+		}
+	}
+
+	// Responses are streamed as they come, so long polls and server-sent
+	// events of the upstream site work as well.
+	proxy.FlushInterval = -1
+	return proxy, nil
+}
@@ -2,14 +2,23 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+
+	"github.com/neex/tcp-over-http/transport"
 )
 
+const establishPrefix = "/establish/"
+
 func RunHTTPServer(config *Config) error {
 	mux := makeHTTPMux(config)
 	srv := http.Server{
@@ -19,7 +28,19 @@ func RunHTTPServer(config *Config) error {
 
 	if config.IsHTTPS() {
 		srv.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{config.Certificate},
+			GetCertificate: config.getCertificate,
+		}
+
+		if config.ClientCAs != nil {
+			srv.TLSConfig.ClientCAs = config.ClientCAs
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if config.RequireClientCert {
+				srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+
+		if config.ACMEManager != nil {
+			srv.TLSConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
 		}
 
 		return srv.ListenAndServeTLS("", "")
@@ -29,49 +50,187 @@ func RunHTTPServer(config *Config) error {
 }
 
 func makeHTTPMux(config *Config) http.Handler {
+	polls := transport.NewPollSessions()
+	sites := make(map[*VirtualHost]http.Handler)
+	for _, vh := range config.VirtualHosts {
+		sites[vh] = makeSiteMux(config, vh, polls)
+	}
+
+	return CheckHost(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sites[config.virtualHost(r.Host)].ServeHTTP(w, r)
+	}))
+}
+
+func makeSiteMux(config *Config, vh *VirtualHost, polls *transport.PollSessions) http.Handler {
 	mux := http.NewServeMux()
-	static := http.FileServer(http.Dir(config.StaticDir))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.WithFields(log.Fields{
 			"remote_addr": r.RemoteAddr,
 			"remote_uri":  r.RequestURI,
-		}).Info("static request")
-		static.ServeHTTP(w, r)
+			"host":        r.Host,
+		}).Info("cover request")
+		vh.Cover.ServeHTTP(w, r)
 	})
 
-	mux.HandleFunc(fmt.Sprintf("/establish/%s", config.Token), func(w http.ResponseWriter, r *http.Request) {
-		l := log.WithFields(log.Fields{
-			"remote_addr": r.RemoteAddr,
-		})
+	mux.HandleFunc(vh.EstablishPath, func(w http.ResponseWriter, r *http.Request) {
+		user := config.Registry.Authenticate(strings.TrimPrefix(r.URL.Path, vh.EstablishPath))
+		if user == nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			// Client certificates are verified during the handshake.
+			user = config.Registry.AuthenticateCertificate(r.TLS.PeerCertificates[0])
+		}
 
-		l.Info("proxy request")
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			l.Error("connection doesn't support http.Hijacker")
-			w.WriteHeader(500)
-			return
+		if user == nil {
+			var err error
+			if user, err = config.authenticateRequest(r); err != nil {
+				log.WithFields(log.Fields{
+					"remote_addr": r.RemoteAddr,
+					"remote_uri":  r.RequestURI,
+				}).WithError(err).Debug("proxy request with invalid auth token")
+				vh.Cover.ServeHTTP(w, r)
+				return
+			}
 		}
 
-		conn, br, err := hj.Hijack()
-		if err != nil {
-			l.WithError(err).Error("error while hijacking connection")
-			w.WriteHeader(500)
+		if user == nil {
+			log.WithFields(log.Fields{
+				"remote_addr": r.RemoteAddr,
+				"remote_uri":  r.RequestURI,
+			}).Warn("proxy request with unknown or revoked token")
+			vh.Cover.ServeHTTP(w, r)
 			return
 		}
 
-		d := net.Dialer{
-			Timeout: config.DialTimeout,
-		}
+		serveTunnel(config, polls, user, w, r)
+	})
 
-		hc := &hijackedConn{br: br, Conn: conn}
-		if err := RunMultiplexedServer(r.Context(), hc, d.DialContext); err != nil {
-			l.WithError(err).Error("connection handling ended with error")
-		}
+	return mux
+}
 
-		l.Info("proxy request finished")
+func serveTunnel(config *Config, polls *transport.PollSessions, user *User, w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"user":        user.Name,
 	})
 
-	return CheckHost(config, mux)
+	if transport.IsPollRequest(r) {
+		polls.Serve(w, r, func(conn net.Conn) {
+			l.Info("polling proxy session")
+			runSession(context.Background(), config, conn, user, l)
+			_ = conn.Close()
+			l.Info("polling proxy session finished")
+		})
+		return
+	}
+
+	l.Info("proxy request")
+	var conn net.Conn
+	var err error
+	if r.ProtoMajor == 2 {
+		conn, err = streamTunnel(w, r)
+	} else {
+		conn, err = hijackTunnel(w, r)
+	}
+
+	if err != nil {
+		l.WithError(err).Error("error while taking over connection")
+		w.WriteHeader(500)
+		return
+	}
+
+	runSession(r.Context(), config, conn, user, l)
+	_ = conn.Close()
+	l.Info("proxy request finished")
+}
+
+// hijackTunnel takes over the connection the request came in. If the client
+// asked for a websocket, the handshake is completed and the tunnel is carried
+// in websocket frames.
+func hijackTunnel(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection doesn't support http.Hijacker")
+	}
+
+	conn, br, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &hijackedConn{br: br, Conn: conn}
+	if !transport.IsWebSocketRequest(r) {
+		return hc, nil
+	}
+
+	_, _ = fmt.Fprintf(br, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", transport.WebSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+	if err := br.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return transport.NewWebSocketConn(hc, nil, false), nil
+}
+
+// streamTunnel runs the tunnel over the bodies of an HTTP/2 request and its
+// response, which can't be hijacked.
+func streamTunnel(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("connection doesn't support http.Flusher")
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	return transport.NewStreamConn(r.Body, &flushWriter{w: w, flusher: flusher}, nil, nil), nil
+}
+
+func runSession(ctx context.Context, config *Config, conn net.Conn, user *User, l *log.Entry) {
+	d := net.Dialer{
+		Timeout: config.DialTimeout,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	untrack := config.Registry.trackSession(user, cancel)
+	defer untrack()
+
+	acl := config.CurrentACL()
+	if user.ACL != nil {
+		acl = user.ACL
+	}
+
+	srvCfg := &MultiplexedServerConfig{
+		User:        user,
+		Dial:        ACLDialMiddleware(acl, d.DialContext),
+		ACL:         acl,
+		Logger:      l,
+		MaxStreams:  config.MaxStreams,
+		DialTimeout: config.DialTimeout,
+
+		MaxObfuscationOverhead: config.MaxObfuscationOverhead,
+		MinChaffInterval:       config.MinChaffInterval,
+		NoiseKey:               config.NoiseKey,
+		BindAddress:            config.BindAddress,
+	}
+
+	if err := RunMultiplexedServer(ctx, conn, srvCfg); err != nil {
+		l.WithError(err).Error("connection handling ended with error")
+	}
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.flusher.Flush()
+	return n, err
 }
 
 type hijackedConn struct {
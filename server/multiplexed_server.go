@@ -1,22 +1,70 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/flynn/noise"
 	"github.com/hashicorp/yamux"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/neex/tcp-over-http/common"
 	"github.com/neex/tcp-over-http/protocol"
+	"github.com/neex/tcp-over-http/transport"
 )
 
-func RunMultiplexedServer(ctx context.Context, conn net.Conn, dial common.DialContextFunc) error {
+// Defaults of the obfuscation limits. The client picks the parameters of
+// the server direction, so they have to be bounded: by default, padding and
+// chaff can double the traffic at most.
+const (
+	defaultMaxObfuscationOverhead = 1.0
+	defaultMinChaffInterval       = 100 * time.Millisecond
+)
+
+// bindAcceptTimeout is how long the listener of a bind request waits for the
+// inbound connection.
+const bindAcceptTimeout = 2 * time.Minute
+
+type MultiplexedServerConfig struct {
+	User       *User
+	Dial       common.DialContextFunc
+	Logger     *log.Entry
+	MaxStreams int
+
+	// DialTimeout is announced to the client, Dial enforces it.
+	DialTimeout time.Duration
+
+	// MaxObfuscationOverhead caps the overhead budget of the obfuscation
+	// layer in the server direction, zero means the client decides.
+	// MinChaffInterval keeps the client from asking for a flood of chaff.
+	MaxObfuscationOverhead float64
+	MinChaffInterval       time.Duration
+
+	// NoiseKey is the static key of the server for the encryption layer,
+	// nil if it is off.
+	NoiseKey *noise.DHKey
+
+	// BindAddress is the IP to listen on for bind requests, empty if they
+	// are not allowed. The user must have AllowBind as well.
+	BindAddress string
+
+	// ACL is the one Dial checks, bind peers are checked against it too.
+	ACL *ACL
+}
+
+func (c *MultiplexedServerConfig) bindAllowed() bool {
+	return c.BindAddress != "" && c.User.AllowBind
+}
+
+func RunMultiplexedServer(ctx context.Context, conn net.Conn, config *MultiplexedServerConfig) error {
 	newCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	go func() {
@@ -24,22 +72,98 @@ func RunMultiplexedServer(ctx context.Context, conn net.Conn, dial common.DialCo
 		_ = conn.Close()
 	}()
 
-	packet := &protocol.ConnectionResponse{
+	limits := protocol.Limits{
+		MaxStreamsPerSession: config.MaxStreams,
+		DialTimeout:          config.DialTimeout,
+	}
+
+	// The server speaks first, so that clients can tell it negotiates
+	// features before sending the hello. Clients without negotiation take
+	// the offer for the initial response and ignore the hello in it.
+	offer := &protocol.ConnectionResponse{
 		Err:     nil,
 		Padding: hex.EncodeToString(make([]byte, rand.Intn(2)*500+500)),
+		Hello:   protocol.NewServerOffer(serverFeatures(config), limits),
 	}
 
-	if err := protocol.WritePacket(ctx, conn, packet); err != nil {
+	if err := protocol.WritePacket(ctx, conn, offer); err != nil {
 		return fmt.Errorf("error while writing initial response: %v", err)
 	}
 
+	hello, conn, err := readClientHello(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("error while reading client hello: %v", err)
+	}
+
+	// A user with a noise key is trusted on the key, not only on the token
+	// or certificate, which a TLS-terminating proxy might have seen.
+	requireNoise := config.NoiseKey != nil && config.User.noisePublicKey != nil
+	errNoiseRequired := errors.New("noise encryption is required for the user")
+
+	packet := &protocol.ConnectionResponse{}
+	if hello != nil {
+		packet.Hello = protocol.NewServerHello(hello, serverFeatures(config), limits)
+		if packet.Hello.Obfuscation != nil {
+			params := packet.Hello.Obfuscation.
+				LimitOverhead(config.MaxObfuscationOverhead).
+				LimitChaff(config.MinChaffInterval)
+			packet.Hello.Obfuscation = &params
+		}
+		config.Logger.WithFields(log.Fields{
+			"version":  packet.Hello.Version,
+			"features": packet.Hello.Features,
+		}).Debug("hello negotiated")
+
+		if requireNoise && !packet.Hello.Noise {
+			reason := errNoiseRequired.Error()
+			_ = protocol.WritePacket(ctx, conn, &protocol.ConnectionResponse{Err: &reason, Code: protocol.CodeNotAllowed})
+			return errNoiseRequired
+		}
+
+		if err := protocol.WritePacket(ctx, conn, packet); err != nil {
+			return fmt.Errorf("error while writing hello: %v", err)
+		}
+	} else if requireNoise {
+		return errNoiseRequired
+	}
+
+	if packet.Hello != nil && packet.Hello.Obfuscation != nil {
+		oc := transport.NewObfsConn(conn, *packet.Hello.Obfuscation)
+		defer func() {
+			data, overhead := oc.Stats()
+			config.Logger.WithFields(log.Fields{
+				"data":     data,
+				"overhead": overhead,
+			}).Info("obfuscation stats")
+			_ = oc.Close()
+		}()
+		conn = oc
+	}
+
+	if packet.Hello != nil && packet.Hello.Noise {
+		nc, err := transport.NewNoiseConn(conn, *config.NoiseKey, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := nc.Handshake(); err != nil {
+			return fmt.Errorf("error in noise handshake: %v", err)
+		}
+
+		if !bytes.Equal(nc.PeerStatic(), config.User.noisePublicKey) {
+			return errors.New("noise static key doesn't belong to the user")
+		}
+		conn = nc
+	}
+
 	conf := *yamux.DefaultConfig()
-	conf.LogOutput = log.StandardLogger().WriterLevel(log.ErrorLevel)
+	conf.LogOutput = config.Logger.WriterLevel(log.ErrorLevel)
 	sess, err := yamux.Server(conn, &conf)
 	if err != nil {
 		return fmt.Errorf("error while creating server: %v", err)
 	}
 
+	streams := 0
 	for {
 		client, err := sess.Accept()
 		if err == io.EOF {
@@ -50,12 +174,81 @@ func RunMultiplexedServer(ctx context.Context, conn net.Conn, dial common.DialCo
 			return fmt.Errorf("error while accept: %v", err)
 		}
 
+		streams++
+		if config.MaxStreams > 0 && streams > config.MaxStreams {
+			go func() {
+				_ = refuseClient(newCtx, client, "stream limit exceeded")
+			}()
+			continue
+		}
+
 		go func() {
-			_ = processClient(newCtx, client, dial)
+			_ = processClient(newCtx, client, config)
 		}()
 	}
 }
 
+// serverFeatures leaves out encryption unless both the server and the user
+// have keys for it, and bind unless it is allowed.
+func serverFeatures(config *MultiplexedServerConfig) []protocol.Feature {
+	var features []protocol.Feature
+	for _, f := range protocol.SupportedFeatures {
+		if f == protocol.FeatureNoise && (config.NoiseKey == nil || config.User.noisePublicKey == nil) {
+			continue
+		}
+		if f == protocol.FeatureBind && !config.bindAllowed() {
+			continue
+		}
+		features = append(features, f)
+	}
+	return features
+}
+
+// readClientHello reads the hello the client sends first in the tunnel.
+// Clients without feature negotiation start right away with multiplexer
+// frames, whose first byte is the zero yamux version, and get nil. The
+// returned connection gives back the byte that was looked at.
+func readClientHello(ctx context.Context, conn net.Conn) (*protocol.ClientHello, net.Conn, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return nil, conn, err
+	}
+
+	conn = &prefixConn{prefix: first[:], Conn: conn}
+	if first[0] == 0 {
+		return nil, conn, nil
+	}
+
+	hello, err := protocol.ReadClientHello(ctx, conn)
+	return hello, conn, err
+}
+
+type prefixConn struct {
+	prefix []byte
+	net.Conn
+}
+
+func (pc *prefixConn) Read(b []byte) (int, error) {
+	if len(pc.prefix) > 0 {
+		n := copy(b, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return n, nil
+	}
+	return pc.Conn.Read(b)
+}
+
+func refuseClient(ctx context.Context, conn net.Conn, reason string) error {
+	defer func() { _ = conn.Close() }()
+
+	req, err := protocol.ReadRequest(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	resp := &protocol.ConnectionResponse{Err: &reason, Code: protocol.CodeGeneralFailure}
+	return protocol.WriteFramedPacket(ctx, conn, req.Framing, resp)
+}
+
 var isPacket = map[string]bool{
 	"tcp":  false,
 	"tcp4": false,
@@ -65,7 +258,7 @@ var isPacket = map[string]bool{
 	"udp6": true,
 }
 
-func processClient(ctx context.Context, conn net.Conn, dial common.DialContextFunc) error {
+func processClient(ctx context.Context, conn net.Conn, config *MultiplexedServerConfig) error {
 	newCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	go func() {
@@ -77,25 +270,33 @@ func processClient(ctx context.Context, conn net.Conn, dial common.DialContextFu
 	if err != nil {
 		return err
 	}
+	if req.Network == protocol.NetworkBind && config.bindAllowed() {
+		return processBind(newCtx, conn, req, config)
+	}
+
 	needPacket, ok := isPacket[req.Network]
 	if !ok {
 		err := fmt.Sprintf("Network %#v not allowed", req.Network)
-		return protocol.WritePacket(newCtx, conn, &protocol.ConnectionResponse{Err: &err})
+		resp := &protocol.ConnectionResponse{Err: &err, Code: protocol.CodeNetworkNotSupported}
+		return protocol.WriteFramedPacket(newCtx, conn, req.Framing, resp)
 	}
 	dialCtx, cancelDialCtx := context.WithTimeout(newCtx, req.Timeout)
-	upstreamConn, err := dial(dialCtx, req.Network, req.Address)
+	upstreamConn, err := config.Dial(dialCtx, req.Network, req.Address)
 	if upstreamConn != nil {
 		defer func() { _ = upstreamConn.Close() }()
 	}
 	cancelDialCtx()
 
-	var errStr *string
+	resp := &protocol.ConnectionResponse{}
 	if err != nil {
-		errStr = new(string)
-		*errStr = err.Error()
+		resp = protocol.ErrorResponse(err)
+		config.Logger.WithFields(log.Fields{
+			"remote": req.Address,
+			"code":   resp.Code,
+		}).WithError(err).Debug("error while dialing")
 	}
 
-	writeErr := protocol.WritePacket(newCtx, conn, &protocol.ConnectionResponse{Err: errStr})
+	writeErr := protocol.WriteFramedPacket(newCtx, conn, req.Framing, resp)
 	if err != nil {
 		return err
 	}
@@ -107,6 +308,120 @@ func processClient(ctx context.Context, conn net.Conn, dial common.DialContextFu
 		conn = protocol.NewPacketConnection(conn)
 	}
 
+	relay(conn, upstreamConn)
+	return nil
+}
+
+// processBind listens on a port of the bind address and relays the first
+// inbound connection back to the client. If the client gave the address of
+// the expected peer, connections from other hosts are dropped.
+func processBind(ctx context.Context, conn net.Conn, req *protocol.ConnectionRequest, config *MultiplexedServerConfig) error {
+	logger := config.Logger.WithField("expected_peer", req.Address)
+
+	peerAllowed, err := bindPeerCheck(ctx, config.ACL, req.Address)
+	if err != nil {
+		logger.WithError(err).Warn("bind refused")
+		return protocol.WriteFramedPacket(ctx, conn, req.Framing, protocol.ErrorResponse(err))
+	}
+
+	lsn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(config.BindAddress)})
+	if err != nil {
+		logger.WithError(err).Error("bind listen failed")
+		return protocol.WriteFramedPacket(ctx, conn, req.Framing, protocol.ErrorResponse(err))
+	}
+	defer func() { _ = lsn.Close() }()
+
+	go func() {
+		<-ctx.Done()
+		_ = lsn.Close()
+	}()
+
+	resp := &protocol.ConnectionResponse{Addr: lsn.Addr().String()}
+	if err := protocol.WriteFramedPacket(ctx, conn, req.Framing, resp); err != nil {
+		return err
+	}
+
+	logger = logger.WithField("bind_addr", lsn.Addr())
+	logger.Debug("waiting for inbound connection")
+
+	_ = lsn.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	var peer *net.TCPConn
+	for peer == nil {
+		c, err := lsn.AcceptTCP()
+		if err != nil {
+			logger.WithError(err).Debug("no inbound connection")
+			return protocol.WriteFramedPacket(ctx, conn, req.Framing, protocol.ErrorResponse(err))
+		}
+
+		if !peerAllowed(c.RemoteAddr().(*net.TCPAddr).IP) {
+			logger.WithField("peer", c.RemoteAddr()).Warn("inbound connection from unexpected peer dropped")
+			_ = c.Close()
+			continue
+		}
+		peer = c
+	}
+	defer func() { _ = peer.Close() }()
+	_ = lsn.Close()
+
+	resp = &protocol.ConnectionResponse{Addr: peer.RemoteAddr().String()}
+	if err := protocol.WriteFramedPacket(ctx, conn, req.Framing, resp); err != nil {
+		return err
+	}
+
+	logger.WithField("peer", peer.RemoteAddr()).Debug("inbound connection accepted")
+	relay(conn, peer)
+	return nil
+}
+
+// bindPeerCheck makes the check for the peers of a bind request. The expected
+// peer address is resolved and checked against the acl like a dial
+// destination, and then only peers with the allowed addresses are accepted.
+// With an unspecified address, any peer is accepted the acl allows to dial
+// at the requested port.
+func bindPeerCheck(ctx context.Context, acl *ACL, address string) (func(net.IP) bool, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.DefaultResolver.LookupPort(ctx, "tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return func(peer net.IP) bool {
+			return acl.Allowed("tcp", peer.String(), peer, port)
+		}, nil
+	}
+
+	ips, err := resolve(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []net.IP
+	for _, ip := range ips {
+		if acl.Allowed("tcp", host, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, &DeniedError{Address: address}
+	}
+
+	return func(peer net.IP) bool {
+		for _, ip := range allowed {
+			if ip.Equal(peer) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func relay(conn, upstreamConn net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -124,5 +439,4 @@ func processClient(ctx context.Context, conn net.Conn, dial common.DialContextFu
 	}()
 
 	wg.Wait()
-	return nil
 }
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neex/tcp-over-http/protocol"
+	"github.com/neex/tcp-over-http/transport"
+)
+
+func echoDial(ctx context.Context, network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go func() {
+		_, _ = io.Copy(c2, c2)
+		_ = c2.Close()
+	}()
+	return c1, nil
+}
+
+func TestRunMultiplexedServerBaselineClient(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+
+	config := &MultiplexedServerConfig{
+		User:   &User{},
+		Dial:   echoDial,
+		Logger: log.NewEntry(log.StandardLogger()),
+	}
+	go func() { _ = RunMultiplexedServer(context.Background(), c2, config) }()
+
+	// Clients without feature negotiation take the offer for the initial
+	// response and start the multiplexer.
+	resp, err := protocol.ReadResponse(context.Background(), c1)
+	if err != nil || resp.Err != nil {
+		t.Fatalf("initial response %+v, error %v", resp, err)
+	}
+	if resp.Hello == nil || !protocol.HasFeature(resp.Hello.Features, protocol.FeatureBinaryFraming) {
+		t.Fatalf("features aren't offered: %+v", resp.Hello)
+	}
+
+	sess, err := yamux.Client(c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sess.Close() }()
+
+	stream, err := sess.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &struct {
+		Network string
+		Address string
+		Timeout time.Duration
+	}{"tcp", "echo.example.com:7", time.Second}
+	if err := protocol.WritePacket(context.Background(), stream, req); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = protocol.ReadResponse(context.Background(), stream)
+	if err != nil || resp.Err != nil {
+		t.Fatalf("response %+v, error %v", resp, err)
+	}
+
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+}
+
+func TestRunMultiplexedServerHello(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+
+	config := &MultiplexedServerConfig{
+		User:       &User{},
+		Dial:       echoDial,
+		Logger:     log.NewEntry(log.StandardLogger()),
+		MaxStreams: 10,
+	}
+	go func() { _ = RunMultiplexedServer(context.Background(), c2, config) }()
+
+	offer, err := protocol.ReadResponse(context.Background(), c1)
+	if err != nil || offer.Hello == nil {
+		t.Fatalf("offer %+v, error %v", offer, err)
+	}
+	if offer.Hello.Obfuscation != nil || offer.Hello.Noise {
+		t.Errorf("layers are turned on in the offer: %+v", offer.Hello)
+	}
+
+	hello := protocol.NewClientHello([]protocol.Feature{protocol.FeatureUDP, "compression"})
+	if err := protocol.WritePacket(context.Background(), c1, hello); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := protocol.ReadResponse(context.Background(), c1)
+	if err != nil || resp.Hello == nil {
+		t.Fatalf("hello response %+v, error %v", resp, err)
+	}
+	if len(resp.Hello.Features) != 1 || resp.Hello.Features[0] != protocol.FeatureUDP {
+		t.Errorf("negotiated features %v", resp.Hello.Features)
+	}
+	if resp.Hello.Limits.MaxStreamsPerSession != 10 {
+		t.Errorf("limits %+v", resp.Hello.Limits)
+	}
+}
+
+func TestServerFeaturesBind(t *testing.T) {
+	tests := []struct {
+		bindAddress string
+		allowBind   bool
+		bind        bool
+	}{
+		{"", false, false},
+		{"", true, false},
+		{"192.0.2.1", false, false},
+		{"192.0.2.1", true, true},
+	}
+
+	for _, tt := range tests {
+		config := &MultiplexedServerConfig{
+			User:        &User{AllowBind: tt.allowBind},
+			BindAddress: tt.bindAddress,
+		}
+
+		if got := protocol.HasFeature(serverFeatures(config), protocol.FeatureBind); got != tt.bind {
+			t.Errorf("bind_address %#v, allow_bind %v: bind feature %v", tt.bindAddress, tt.allowBind, got)
+		}
+	}
+}
+
+func TestBindPeerCheck(t *testing.T) {
+	defer func(orig func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = orig }(lookupIPAddr)
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "ftp.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("1.1.1.1")}, {IP: net.ParseIP("2606:4700::1")}}, nil
+		case "internal.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	allowAll := mustCompile(t, &ACL{Default: ACLAllow})
+	hostsOnly := mustCompile(t, &ACL{
+		Default: ACLDeny,
+		Rules:   []*ACLRule{{Action: ACLAllow, Hosts: []string{"*.example.com"}, Ports: []string{"20-21"}}},
+	})
+
+	tests := []struct {
+		acl      *ACL
+		address  string
+		denied   bool
+		accepted []string
+		dropped  []string
+	}{
+		{allowAll, "ftp.example.com:21", false, []string{"1.1.1.1", "2606:4700::1", "::ffff:1.1.1.1"}, []string{"127.0.0.1", "8.8.8.8"}},
+		{allowAll, "1.1.1.1:21", false, []string{"1.1.1.1"}, []string{"1.1.1.2"}},
+		{allowAll, "127.0.0.1:21", true, nil, nil},
+		{allowAll, "internal.example.com:21", true, nil, nil},
+		{allowAll, "0.0.0.0:0", false, []string{"1.1.1.1", "8.8.8.8"}, []string{"10.0.0.1", "169.254.169.254", "::1"}},
+		{hostsOnly, "ftp.example.com:21", false, []string{"1.1.1.1"}, []string{"8.8.8.8"}},
+		{hostsOnly, "ftp.example.com:22", true, nil, nil},
+		{hostsOnly, "1.1.1.1:21", true, nil, nil},
+		{hostsOnly, "0.0.0.0:21", false, nil, []string{"1.1.1.1"}},
+	}
+
+	for _, tt := range tests {
+		check, err := bindPeerCheck(context.Background(), tt.acl, tt.address)
+		if tt.denied {
+			if _, ok := err.(*DeniedError); !ok {
+				t.Errorf("%v: error %v, want denied", tt.address, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: %v", tt.address, err)
+			continue
+		}
+
+		for _, peer := range tt.accepted {
+			if !check(net.ParseIP(peer)) {
+				t.Errorf("%v: peer %v dropped", tt.address, peer)
+			}
+		}
+
+		for _, peer := range tt.dropped {
+			if check(net.ParseIP(peer)) {
+				t.Errorf("%v: peer %v accepted", tt.address, peer)
+			}
+		}
+	}
+
+	if _, err := bindPeerCheck(context.Background(), allowAll, "nowhere.example.com:21"); err == nil {
+		t.Error("no error for unresolvable peer")
+	}
+}
+
+func TestRunMultiplexedServerLimitsObfuscation(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+
+	config := &MultiplexedServerConfig{
+		User:                   &User{},
+		Dial:                   echoDial,
+		Logger:                 log.NewEntry(log.StandardLogger()),
+		MaxObfuscationOverhead: defaultMaxObfuscationOverhead,
+		MinChaffInterval:       defaultMinChaffInterval,
+	}
+	go func() { _ = RunMultiplexedServer(context.Background(), c2, config) }()
+
+	if _, err := protocol.ReadResponse(context.Background(), c1); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := protocol.NewClientHello(protocol.SupportedFeatures)
+	hello.Obfuscation = &protocol.ObfuscationParams{MaxPadding: 1 << 30, ChaffInterval: time.Microsecond}
+	if err := protocol.WritePacket(context.Background(), c1, hello); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := protocol.ReadResponse(context.Background(), c1)
+	if err != nil || resp.Hello == nil || resp.Hello.Obfuscation == nil {
+		t.Fatalf("hello response %+v, error %v", resp, err)
+	}
+
+	params := resp.Hello.Obfuscation
+	if params.ChaffInterval != defaultMinChaffInterval || params.MaxOverhead != defaultMaxObfuscationOverhead {
+		t.Errorf("obfuscation isn't limited: %+v", params)
+	}
+}
+
+func TestRunMultiplexedServerRequiresNoise(t *testing.T) {
+	private, _, err := transport.GenerateNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := transport.NoiseKeyFromPrivate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, legacy := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		config := &MultiplexedServerConfig{
+			User:     &User{noisePublicKey: serverKey.Public},
+			Dial:     echoDial,
+			Logger:   log.NewEntry(log.StandardLogger()),
+			NoiseKey: &serverKey,
+		}
+
+		result := make(chan error, 1)
+		go func() { result <- RunMultiplexedServer(context.Background(), c2, config) }()
+
+		offer, err := protocol.ReadResponse(context.Background(), c1)
+		if err != nil || !protocol.HasFeature(offer.Hello.Features, protocol.FeatureNoise) {
+			t.Fatalf("legacy %v: offer %+v, error %v", legacy, offer, err)
+		}
+
+		if legacy {
+			// Multiplexer frames start with the zero version.
+			_, _ = c1.Write([]byte{0})
+		} else {
+			if err := protocol.WritePacket(context.Background(), c1, protocol.NewClientHello(protocol.SupportedFeatures)); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := protocol.ReadResponse(context.Background(), c1)
+			if err != nil || resp.Err == nil || resp.Code != protocol.CodeNotAllowed {
+				t.Errorf("session without noise: response %+v, error %v", resp, err)
+			}
+		}
+
+		select {
+		case err := <-result:
+			if err == nil {
+				t.Errorf("legacy %v: session without noise is served", legacy)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("legacy %v: session without noise is served", legacy)
+		}
+		_ = c1.Close()
+	}
+}
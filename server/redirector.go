@@ -3,12 +3,23 @@ package server
 import "net/http"
 
 func RunRedirectorServer(config *Config) error {
-	return http.ListenAndServe(config.RedirectorAddr, CheckHost(config, http.HandlerFunc(
+	return http.ListenAndServe(config.RedirectorAddr, redirectorHandler(config))
+}
+
+func redirectorHandler(config *Config) http.Handler {
+	var handler http.Handler = http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			url := *r.URL
 			url.Scheme = "https"
 			url.Host = r.Host
 			http.Redirect(w, r, url.String(), 301)
 		},
-	)))
+	)
+
+	if config.ACMEManager != nil {
+		// Answers http-01 challenges, redirects everything else.
+		handler = config.ACMEManager.HTTPHandler(handler)
+	}
+
+	return CheckHost(config, handler)
 }
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neex/tcp-over-http/protocol"
+	"github.com/neex/tcp-over-http/transport"
+)
+
+type User struct {
+	Name        string `yaml:"name"`
+	Token       string `yaml:"token"`
+	Key         string `yaml:"key"`
+	CertSubject string `yaml:"cert_subject"`
+	Disabled    bool   `yaml:"disabled"`
+
+	// NoisePublicKey is the static key the user proves in the handshake of
+	// the encryption layer.
+	NoisePublicKey string `yaml:"noise_public_key"`
+	noisePublicKey []byte
+
+	// ACL overrides the server-wide ACL for the user.
+	ACL *ACL `yaml:"acl"`
+
+	// AllowBind lets the user accept inbound connections if the server has
+	// a bind_address.
+	AllowBind bool `yaml:"allow_bind"`
+}
+
+// UserRegistry holds the users allowed to establish sessions and keeps
+// track of their live sessions, so a revoked user can be kicked out.
+type UserRegistry struct {
+	m        sync.Mutex
+	users    []*User
+	sessions map[string]map[uint64]context.CancelFunc
+	lastID   uint64
+}
+
+func NewUserRegistry(users []*User) *UserRegistry {
+	return &UserRegistry{
+		users:    users,
+		sessions: make(map[string]map[uint64]context.CancelFunc),
+	}
+}
+
+// Authenticate returns the enabled user owning the token, or nil.
+func (r *UserRegistry) Authenticate(token string) *User {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var found *User
+	for _, u := range r.users {
+		if u.Token != "" && subtle.ConstantTimeCompare([]byte(u.Token), []byte(token)) == 1 {
+			found = u
+		}
+	}
+
+	if found == nil || found.Disabled {
+		return nil
+	}
+
+	return found
+}
+
+// AuthenticateKey returns the enabled user whose key signed the auth token,
+// or nil.
+func (r *UserRegistry) AuthenticateKey(token *protocol.AuthToken) *User {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var found *User
+	for _, u := range r.users {
+		if u.Key != "" && token.Verify(u.Key) {
+			found = u
+		}
+	}
+
+	if found == nil || found.Disabled {
+		return nil
+	}
+
+	return found
+}
+
+// AuthenticateCertificate returns the enabled user mapped to the subject of
+// a verified client certificate, or nil. The subject is matched either by
+// common name or as a whole.
+func (r *UserRegistry) AuthenticateCertificate(cert *x509.Certificate) *User {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var found *User
+	for _, u := range r.users {
+		if u.CertSubject != "" &&
+			(u.CertSubject == cert.Subject.CommonName || u.CertSubject == cert.Subject.String()) {
+			found = u
+		}
+	}
+
+	if found == nil || found.Disabled {
+		return nil
+	}
+
+	return found
+}
+
+// Update replaces the user list. Users that are missing from the new list
+// or disabled in it are refused from now on; their live sessions are torn
+// down if killRevoked is set.
+func (r *UserRegistry) Update(users []*User, killRevoked bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	enabled := make(map[string]bool)
+	for _, u := range users {
+		if !u.Disabled {
+			enabled[u.Name] = true
+		}
+	}
+
+	for _, u := range r.users {
+		if u.Disabled || enabled[u.Name] {
+			continue
+		}
+
+		logger := log.WithField("user", u.Name)
+		logger.Warn("user revoked")
+		if !killRevoked {
+			continue
+		}
+
+		for _, cancel := range r.sessions[u.Name] {
+			cancel()
+		}
+
+		if n := len(r.sessions[u.Name]); n > 0 {
+			logger.WithField("sessions", n).Warn("live sessions of revoked user closed")
+		}
+	}
+
+	r.users = users
+}
+
+func (r *UserRegistry) trackSession(user *User, cancel context.CancelFunc) (untrack func()) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.lastID++
+	id := r.lastID
+	if r.sessions[user.Name] == nil {
+		r.sessions[user.Name] = make(map[uint64]context.CancelFunc)
+	}
+	r.sessions[user.Name][id] = cancel
+
+	return func() {
+		r.m.Lock()
+		defer r.m.Unlock()
+
+		delete(r.sessions[user.Name], id)
+		if len(r.sessions[user.Name]) == 0 {
+			delete(r.sessions, user.Name)
+		}
+	}
+}
+
+func validateUsers(users []*User) error {
+	if len(users) == 0 {
+		return errors.New("no users configured")
+	}
+
+	seenNames := make(map[string]bool)
+	seenTokens := make(map[string]bool)
+	seenKeys := make(map[string]bool)
+	seenSubjects := make(map[string]bool)
+	for _, u := range users {
+		if u.Name == "" {
+			return errors.New("user without name")
+		}
+
+		if seenNames[u.Name] {
+			return fmt.Errorf("duplicate user %#v", u.Name)
+		}
+		seenNames[u.Name] = true
+
+		if u.Token == "" && u.Key == "" && u.CertSubject == "" {
+			return fmt.Errorf("user %#v has neither token, key nor cert_subject", u.Name)
+		}
+
+		if u.Token != "" && seenTokens[u.Token] {
+			return fmt.Errorf("user %#v has the same token as another user", u.Name)
+		}
+		seenTokens[u.Token] = true
+
+		if u.Key != "" && seenKeys[u.Key] {
+			return fmt.Errorf("user %#v has the same key as another user", u.Name)
+		}
+		seenKeys[u.Key] = true
+
+		if u.CertSubject != "" && seenSubjects[u.CertSubject] {
+			return fmt.Errorf("user %#v has the same cert_subject as another user", u.Name)
+		}
+		seenSubjects[u.CertSubject] = true
+
+		if u.NoisePublicKey != "" {
+			key, err := transport.DecodeNoisePublicKey(u.NoisePublicKey)
+			if err != nil {
+				return fmt.Errorf("user %#v: %v", u.Name, err)
+			}
+			u.noisePublicKey = key
+		}
+
+		if u.ACL != nil {
+			if err := u.ACL.compile(); err != nil {
+				return fmt.Errorf("acl of user %#v: %v", u.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -6,13 +6,11 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// CheckHost refuses requests for hosts that aren't served, unless there's a
+// default site.
 func CheckHost(config *Config, handler http.Handler) http.Handler {
-	if config.Domain == "" {
-		return handler
-	}
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Host != config.Domain {
+		if config.virtualHost(r.Host) == nil {
 			log.WithFields(log.Fields{
 				"host":        r.Host,
 				"remote_addr": r.RemoteAddr,
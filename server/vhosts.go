@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// VirtualHost is a site served by the server. Each one has its own cover
+// content and may use its own path for tunnel requests.
+type VirtualHost struct {
+	Domain        string `yaml:"domain"`
+	StaticDir     string `yaml:"static_dir"`
+	Upstream      string `yaml:"upstream"`
+	PreserveHost  bool   `yaml:"preserve_host"`
+	CertPath      string `yaml:"cert_path"`
+	KeyPath       string `yaml:"key_path"`
+	EstablishPath string `yaml:"establish_path"`
+
+	Certificate *CertReloader `yaml:"-"`
+	Cover       http.Handler  `yaml:"-"`
+}
+
+// setupVirtualHosts turns the top-level site settings into a virtual host,
+// validates the list and loads certificates.
+func (c *Config) setupVirtualHosts() error {
+	if len(c.VirtualHosts) == 0 || c.Domain != "" || c.StaticDir != "" || c.Upstream != "" || c.CertPath != "" {
+		legacy := &VirtualHost{
+			Domain:       c.Domain,
+			StaticDir:    c.StaticDir,
+			Upstream:     c.Upstream,
+			PreserveHost: c.PreserveHost,
+			CertPath:     c.CertPath,
+			KeyPath:      c.KeyPath,
+		}
+		c.VirtualHosts = append([]*VirtualHost{legacy}, c.VirtualHosts...)
+	}
+
+	seen := make(map[string]bool)
+	for _, vh := range c.VirtualHosts {
+		key := strings.ToLower(vh.Domain)
+		if seen[key] {
+			return fmt.Errorf("duplicate virtual host %#v", vh.Domain)
+		}
+		seen[key] = true
+
+		if vh.EstablishPath == "" {
+			vh.EstablishPath = establishPrefix
+		}
+		if !strings.HasPrefix(vh.EstablishPath, "/") {
+			vh.EstablishPath = "/" + vh.EstablishPath
+		}
+		if !strings.HasSuffix(vh.EstablishPath, "/") {
+			vh.EstablishPath += "/"
+		}
+
+		var err error
+		if vh.Cover, err = newCoverHandler(vh); err != nil {
+			return err
+		}
+
+		if vh.CertPath != "" {
+			if vh.Certificate, err = NewCertReloader(vh.CertPath, vh.KeyPath); err != nil {
+				return err
+			}
+		} else if c.IsHTTPS() && c.ACME == nil {
+			return fmt.Errorf("virtual host %#v has no certificate", vh.Domain)
+		}
+	}
+
+	if c.DefaultHost != "" && c.exactVirtualHost(c.DefaultHost) == nil {
+		return fmt.Errorf("default host %#v is not among virtual hosts", c.DefaultHost)
+	}
+
+	return nil
+}
+
+// virtualHost finds the site for the given Host header or SNI name. Unknown
+// hosts get the default site, which is either the one named in default_host
+// or the one without a domain. If there's no default site, nil is returned.
+func (c *Config) virtualHost(host string) *VirtualHost {
+	if vh := c.exactVirtualHost(host); vh != nil {
+		return vh
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if vh := c.exactVirtualHost(h); vh != nil {
+			return vh
+		}
+	}
+
+	if c.DefaultHost != "" {
+		return c.exactVirtualHost(c.DefaultHost)
+	}
+	return c.exactVirtualHost("")
+}
+
+func (c *Config) exactVirtualHost(host string) *VirtualHost {
+	for _, vh := range c.VirtualHosts {
+		if strings.EqualFold(vh.Domain, host) {
+			return vh
+		}
+	}
+	return nil
+}
+
+func (c *Config) virtualHostDomains() []string {
+	var domains []string
+	for _, vh := range c.VirtualHosts {
+		if vh.Domain != "" && vh.CertPath == "" {
+			domains = append(domains, vh.Domain)
+		}
+	}
+	return domains
+}
+
+// getCertificate selects the certificate by SNI. Handshakes for unknown names
+// get the certificate of the default site.
+func (c *Config) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	vh := c.virtualHost(hello.ServerName)
+	if vh == nil {
+		return nil, fmt.Errorf("no certificate for %#v", hello.ServerName)
+	}
+
+	if vh.Certificate != nil {
+		return vh.Certificate.GetCertificate(hello)
+	}
+
+	if c.ACMEManager != nil && vh.Domain != "" {
+		h := *hello
+		h.ServerName = vh.Domain
+		return c.ACMEManager.GetCertificate(&h)
+	}
+
+	return nil, errors.New("virtual host has no certificate")
+}
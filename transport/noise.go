@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The encryption layer runs the Noise IK handshake: the client knows the
+// static key of the server and proves its own one, which the server checks
+// against the authenticated user. Messages are prefixed by their length.
+const (
+	noiseMaxMessage = 65535
+	noiseTagSize    = 16
+	noiseMaxPayload = noiseMaxMessage - noiseTagSize
+)
+
+var (
+	noiseSuite    = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	noisePrologue = []byte("tcp-over-http noise v1")
+)
+
+// NoiseConn encrypts everything passing through it. The handshake is done
+// on first Read or Write, or by an explicit Handshake call.
+type NoiseConn struct {
+	net.Conn
+	hs        *noise.HandshakeState
+	initiator bool
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	peerStatic    []byte
+
+	wm   sync.Mutex
+	send *noise.CipherState
+
+	rm      sync.Mutex
+	recv    *noise.CipherState
+	pending []byte
+}
+
+// NewNoiseConn makes the initiator side if peerStatic (the public key of the
+// responder) is given, and the responder side otherwise.
+func NewNoiseConn(conn net.Conn, key noise.DHKey, peerStatic []byte) (*NoiseConn, error) {
+	initiator := peerStatic != nil
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     initiator,
+		Prologue:      noisePrologue,
+		StaticKeypair: key,
+		PeerStatic:    peerStatic,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &NoiseConn{Conn: conn, hs: hs, initiator: initiator}, nil
+}
+
+// NoiseKeyFromPrivate makes the key pair from the base64 private key.
+func NoiseKeyFromPrivate(private string) (noise.DHKey, error) {
+	priv, err := base64.StdEncoding.DecodeString(private)
+	if err != nil || len(priv) != curve25519.ScalarSize {
+		return noise.DHKey{}, errors.New("invalid noise private key")
+	}
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	return noise.DHKey{Private: priv, Public: pub}, nil
+}
+
+// DecodeNoisePublicKey parses the base64 public key.
+func DecodeNoisePublicKey(public string) ([]byte, error) {
+	pub, err := base64.StdEncoding.DecodeString(public)
+	if err != nil || len(pub) != curve25519.PointSize {
+		return nil, errors.New("invalid noise public key")
+	}
+	return pub, nil
+}
+
+// GenerateNoiseKey returns a new base64 key pair.
+func GenerateNoiseKey() (private, public string, err error) {
+	key, err := noiseSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	enc := base64.StdEncoding
+	return enc.EncodeToString(key.Private), enc.EncodeToString(key.Public), nil
+}
+
+// Handshake runs the handshake once and returns its result.
+func (nc *NoiseConn) Handshake() error {
+	nc.handshakeOnce.Do(func() {
+		nc.handshakeErr = nc.handshake()
+		if nc.handshakeErr != nil {
+			_ = nc.Conn.Close()
+		}
+	})
+	return nc.handshakeErr
+}
+
+// PeerStatic returns the static key of the other side after the handshake.
+func (nc *NoiseConn) PeerStatic() []byte {
+	return nc.peerStatic
+}
+
+func (nc *NoiseConn) handshake() error {
+	if nc.initiator {
+		msg, _, _, err := nc.hs.WriteMessage(nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := writeNoiseMessage(nc.Conn, msg); err != nil {
+			return err
+		}
+
+		msg, err = readNoiseMessage(nc.Conn)
+		if err != nil {
+			return err
+		}
+
+		_, cs1, cs2, err := nc.hs.ReadMessage(nil, msg)
+		if err != nil {
+			return err
+		}
+
+		nc.send, nc.recv = cs1, cs2
+	} else {
+		msg, err := readNoiseMessage(nc.Conn)
+		if err != nil {
+			return err
+		}
+
+		if _, _, _, err := nc.hs.ReadMessage(nil, msg); err != nil {
+			return err
+		}
+
+		msg, cs1, cs2, err := nc.hs.WriteMessage(nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := writeNoiseMessage(nc.Conn, msg); err != nil {
+			return err
+		}
+
+		nc.send, nc.recv = cs2, cs1
+	}
+
+	nc.peerStatic = nc.hs.PeerStatic()
+	return nil
+}
+
+func (nc *NoiseConn) Read(b []byte) (int, error) {
+	if err := nc.Handshake(); err != nil {
+		return 0, err
+	}
+
+	nc.rm.Lock()
+	defer nc.rm.Unlock()
+
+	for len(nc.pending) == 0 {
+		msg, err := readNoiseMessage(nc.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		nc.pending, err = nc.recv.Decrypt(msg[:0], nil, msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, nc.pending)
+	nc.pending = nc.pending[n:]
+	return n, nil
+}
+
+func (nc *NoiseConn) Write(b []byte) (int, error) {
+	if err := nc.Handshake(); err != nil {
+		return 0, err
+	}
+
+	nc.wm.Lock()
+	defer nc.wm.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > noiseMaxPayload {
+			n = noiseMaxPayload
+		}
+
+		msg, err := nc.send.Encrypt(nil, nil, b[:n])
+		if err != nil {
+			return written, err
+		}
+
+		if err := writeNoiseMessage(nc.Conn, msg); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+func noiseKey(t *testing.T) noise.DHKey {
+	t.Helper()
+	private, _, err := GenerateNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NoiseKeyFromPrivate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// noisePair makes both ends of a session, the client expecting serverStatic.
+func noisePair(t *testing.T, clientKey, serverKey noise.DHKey, serverStatic []byte) (client, server *NoiseConn, wire net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+
+	client, err := NewNoiseConn(a, clientKey, serverStatic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = NewNoiseConn(b, serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server, a
+}
+
+func TestNoiseRoundTrip(t *testing.T) {
+	clientKey, serverKey := noiseKey(t), noiseKey(t)
+	client, server, _ := noisePair(t, clientKey, serverKey, serverKey.Public)
+	defer func() { _ = client.Close() }()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("hello"))
+		written <- err
+	}()
+
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(server.PeerStatic(), clientKey.Public) {
+		t.Error("server doesn't see the static key of the client")
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(client.PeerStatic(), serverKey.Public) {
+		t.Error("client doesn't see the static key of the server")
+	}
+
+	go func() { _, _ = server.Write([]byte("world")) }()
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "world" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestNoiseWrongServerKey(t *testing.T) {
+	clientKey, serverKey, otherKey := noiseKey(t), noiseKey(t), noiseKey(t)
+	client, server, _ := noisePair(t, clientKey, serverKey, otherKey.Public)
+	defer func() { _ = server.Close() }()
+
+	// The server can't decrypt a first message for another key.
+	handshake := make(chan error, 1)
+	go func() { handshake <- server.Handshake() }()
+
+	go func() { _ = client.Handshake() }()
+	if err := <-handshake; err == nil {
+		t.Fatal("handshake with the wrong server key succeeded")
+	}
+
+	if err := client.Handshake(); err == nil {
+		t.Error("client handshake succeeded")
+	}
+	if _, err := client.Write([]byte("secret")); err == nil {
+		t.Error("write after a failed handshake succeeded")
+	}
+}
+
+func TestNoiseLargeMessages(t *testing.T) {
+	clientKey, serverKey := noiseKey(t), noiseKey(t)
+	a, b := net.Pipe()
+	client, err := NewNoiseConn(a, clientKey, serverKey.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The wire is read by hand to check message sizes.
+	var wire bytes.Buffer
+	server, err := NewNoiseConn(&recordingConn{Conn: b, w: &wire}, serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 200*1024)
+	_, _ = rand.Read(msg)
+	go func() {
+		if _, err := client.Write(msg); err != nil {
+			t.Error(err)
+		}
+		_ = client.Close()
+	}()
+
+	got, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %v bytes, sent %v", len(got), len(msg))
+	}
+
+	messages := 0
+	for wire.Len() > 0 {
+		m, err := readNoiseMessage(&wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) > noiseMaxMessage {
+			t.Errorf("message of %v bytes", len(m))
+		}
+		messages++
+	}
+	if min := 1 + len(msg)/noiseMaxPayload + 1; messages < min {
+		t.Errorf("%v messages on the wire, want at least %v", messages, min)
+	}
+}
+
+// recordingConn copies everything read to w.
+type recordingConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (rc *recordingConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	_, _ = rc.w.Write(b[:n])
+	return n, err
+}
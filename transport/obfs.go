@@ -0,0 +1,269 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+// Every frame of the obfuscation layer is: type (1 byte), payload length
+// and padding length (2 bytes each, big endian), payload, padding. Chaff
+// frames have padding only.
+const (
+	obfsHeaderSize = 5
+	obfsData       = 0
+	obfsChaff      = 1
+
+	obfsMaxFrame    = 16384
+	obfsMinBucket   = 64
+	obfsChaffMin    = 64
+	obfsChaffMax    = 1024
+	obfsBudgetBurst = 16384
+
+	// obfsMinChaffInterval keeps the chaff loop from spinning whatever the
+	// peer asked for.
+	obfsMinChaffInterval = 10 * time.Millisecond
+)
+
+// ObfsConn shapes the traffic of the connection it wraps, see
+// protocol.ObfuscationParams. Both ends have to use it.
+type ObfsConn struct {
+	net.Conn
+	params   protocol.ObfuscationParams
+	buckets  []int
+	maxFrame int
+
+	wm        sync.Mutex
+	rnd       *rand.Rand
+	data      uint64
+	overhead  uint64
+	lastWrite time.Time
+
+	rm          sync.Mutex
+	payloadLeft int
+	padLeft     int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewObfsConn(conn net.Conn, params protocol.ObfuscationParams) *ObfsConn {
+	var buckets []int
+	for _, b := range params.Buckets {
+		if b >= obfsMinBucket && b <= obfsMaxFrame {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.Ints(buckets)
+
+	maxFrame := obfsMaxFrame
+	if len(buckets) > 0 {
+		maxFrame = buckets[len(buckets)-1]
+	}
+
+	// Padding can't make a frame larger than maxFrame anyway.
+	if params.MaxPadding > maxFrame {
+		params.MaxPadding = maxFrame
+	}
+	params = params.LimitChaff(obfsMinChaffInterval)
+
+	oc := &ObfsConn{
+		Conn:      conn,
+		params:    params,
+		buckets:   buckets,
+		maxFrame:  maxFrame,
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		lastWrite: time.Now(),
+		closed:    make(chan struct{}),
+	}
+
+	if params.ChaffInterval > 0 {
+		go oc.chaffLoop()
+	}
+
+	return oc
+}
+
+func (oc *ObfsConn) Read(b []byte) (int, error) {
+	oc.rm.Lock()
+	defer oc.rm.Unlock()
+
+	for oc.payloadLeft == 0 {
+		if oc.padLeft > 0 {
+			if _, err := io.CopyN(ioutil.Discard, oc.Conn, int64(oc.padLeft)); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			oc.padLeft = 0
+		}
+
+		var hdr [obfsHeaderSize]byte
+		if _, err := io.ReadFull(oc.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+
+		payload := int(binary.BigEndian.Uint16(hdr[1:]))
+		pad := int(binary.BigEndian.Uint16(hdr[3:]))
+		switch hdr[0] {
+		case obfsData:
+			oc.payloadLeft, oc.padLeft = payload, pad
+		case obfsChaff:
+			oc.padLeft = payload + pad
+		default:
+			return 0, fmt.Errorf("unknown obfuscation frame type %v", hdr[0])
+		}
+	}
+
+	if len(b) > oc.payloadLeft {
+		b = b[:oc.payloadLeft]
+	}
+
+	n, err := oc.Conn.Read(b)
+	oc.payloadLeft -= n
+	if oc.payloadLeft > 0 {
+		err = unexpectedEOF(err)
+	}
+	return n, err
+}
+
+func (oc *ObfsConn) Write(b []byte) (int, error) {
+	oc.wm.Lock()
+	defer oc.wm.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > oc.maxFrame-obfsHeaderSize {
+			n = oc.maxFrame - obfsHeaderSize
+		}
+
+		if err := oc.writeFrame(obfsData, b[:n], oc.padding(obfsHeaderSize+n)); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (oc *ObfsConn) Close() error {
+	oc.closeOnce.Do(func() { close(oc.closed) })
+	return oc.Conn.Close()
+}
+
+// Stats returns the number of data bytes and of bytes added by the layer
+// (headers, padding and chaff) sent so far.
+func (oc *ObfsConn) Stats() (data, overhead uint64) {
+	oc.wm.Lock()
+	defer oc.wm.Unlock()
+	return oc.data, oc.overhead
+}
+
+// padding decides how much padding a frame of the size gets.
+func (oc *ObfsConn) padding(size int) int {
+	target := size
+	if oc.params.MaxPadding > 0 {
+		target += oc.rnd.Intn(oc.params.MaxPadding + 1)
+	}
+
+	if len(oc.buckets) > 0 {
+		i := sort.SearchInts(oc.buckets, target)
+		if i == len(oc.buckets) {
+			i--
+		}
+		target = oc.buckets[i]
+	}
+
+	if target > oc.maxFrame {
+		target = oc.maxFrame
+	}
+
+	pad := target - size
+	if pad <= 0 || !oc.affordable(pad) {
+		return 0
+	}
+	return pad
+}
+
+// affordable checks that n more overhead bytes fit in the budget. A small
+// burst is allowed on top of it, so short sessions get shaped as well.
+func (oc *ObfsConn) affordable(n int) bool {
+	if oc.params.MaxOverhead <= 0 {
+		return true
+	}
+
+	allowed := oc.params.MaxOverhead*float64(oc.data) + obfsBudgetBurst
+	return float64(oc.overhead)+float64(n) <= allowed
+}
+
+// writeFrame writes the frame in a single Write, so it ends up in a single
+// TLS record.
+func (oc *ObfsConn) writeFrame(typ byte, payload []byte, pad int) error {
+	frame := make([]byte, obfsHeaderSize+len(payload)+pad)
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	binary.BigEndian.PutUint16(frame[3:], uint16(pad))
+	copy(frame[obfsHeaderSize:], payload)
+	_, _ = oc.rnd.Read(frame[obfsHeaderSize+len(payload):])
+
+	if _, err := oc.Conn.Write(frame); err != nil {
+		return err
+	}
+
+	oc.data += uint64(len(payload))
+	oc.overhead += uint64(obfsHeaderSize + pad)
+	oc.lastWrite = time.Now()
+	return nil
+}
+
+func (oc *ObfsConn) chaffLoop() {
+	for {
+		// Jitter the interval by ±50%, so chaff doesn't tick like a clock.
+		interval := oc.params.ChaffInterval
+		wait := interval/2 + time.Duration(rand.Int63n(int64(interval)+1))
+		select {
+		case <-oc.closed:
+			return
+		case <-time.After(wait):
+		}
+
+		if err := oc.sendChaff(); err != nil {
+			return
+		}
+	}
+}
+
+func (oc *ObfsConn) sendChaff() error {
+	oc.wm.Lock()
+	defer oc.wm.Unlock()
+
+	if time.Since(oc.lastWrite) < oc.params.ChaffInterval/2 {
+		return nil
+	}
+
+	size := obfsChaffMin + oc.rnd.Intn(obfsChaffMax-obfsChaffMin+1)
+	if len(oc.buckets) > 0 {
+		size = oc.buckets[oc.rnd.Intn(len(oc.buckets))]
+	}
+
+	if !oc.affordable(size) {
+		return nil
+	}
+	return oc.writeFrame(obfsChaff, nil, size-obfsHeaderSize)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
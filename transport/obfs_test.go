@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neex/tcp-over-http/protocol"
+)
+
+type obfsFrame struct {
+	typ          byte
+	payload, pad int
+}
+
+// readObfsFrames parses the frames off the wire until they carried want
+// bytes of payload, returning them along with the payload.
+func readObfsFrames(t *testing.T, r io.Reader, want int) ([]obfsFrame, []byte) {
+	t.Helper()
+	var frames []obfsFrame
+	var data bytes.Buffer
+	for data.Len() < want {
+		var hdr [obfsHeaderSize]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			t.Fatalf("reading frame header: %v", err)
+		}
+
+		f := obfsFrame{hdr[0], int(binary.BigEndian.Uint16(hdr[1:])), int(binary.BigEndian.Uint16(hdr[3:]))}
+		if _, err := io.CopyN(&data, r, int64(f.payload)); err != nil {
+			t.Fatalf("reading payload: %v", err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(f.pad)); err != nil {
+			t.Fatalf("reading padding: %v", err)
+		}
+		frames = append(frames, f)
+	}
+	return frames, data.Bytes()
+}
+
+func TestObfsFrameFormat(t *testing.T) {
+	a, b := net.Pipe()
+	defer func() { _ = b.Close() }()
+
+	buckets := []int{128, 512, 1024}
+	oc := NewObfsConn(a, protocol.ObfuscationParams{
+		MaxPadding:    100,
+		Buckets:       []int{1024, 128, 512, 1 << 20},
+		ChaffInterval: 20 * time.Millisecond,
+	})
+	defer func() { _ = oc.Close() }()
+
+	rnd := rand.New(rand.NewSource(1))
+	var msgs [][]byte
+	var sent []byte
+	for _, size := range []int{1, 100, 123, 500, 1019, 1020, 5000} {
+		msg := make([]byte, size)
+		_, _ = rnd.Read(msg)
+		msgs = append(msgs, msg)
+		sent = append(sent, msg...)
+	}
+
+	go func() {
+		for _, msg := range msgs {
+			if _, err := oc.Write(msg); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+	}()
+
+	frames, data := readObfsFrames(t, b, len(sent))
+	if !bytes.Equal(data, sent) {
+		t.Errorf("payload corrupted: got %v bytes, sent %v", len(data), len(sent))
+	}
+
+	chaff := 0
+	for _, f := range frames {
+		size := obfsHeaderSize + f.payload + f.pad
+		inBucket := false
+		for _, bucket := range buckets {
+			inBucket = inBucket || size == bucket
+		}
+		if !inBucket {
+			t.Errorf("frame %+v of %v bytes is not a bucket size", f, size)
+		}
+
+		switch f.typ {
+		case obfsChaff:
+			chaff++
+			if f.payload != 0 {
+				t.Errorf("chaff frame with payload: %+v", f)
+			}
+		case obfsData:
+			if f.payload == 0 {
+				t.Errorf("empty data frame: %+v", f)
+			}
+		default:
+			t.Errorf("unknown frame type: %+v", f)
+		}
+	}
+
+	if chaff == 0 {
+		t.Error("no chaff sent while idle")
+	}
+}
+
+func TestObfsRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	params := protocol.ObfuscationParams{MaxPadding: 255, ChaffInterval: 10 * time.Millisecond}
+	client, server := NewObfsConn(a, params), NewObfsConn(b, params)
+	defer func() { _ = server.Close() }()
+
+	msg := make([]byte, 100000)
+	_, _ = rand.New(rand.NewSource(2)).Read(msg)
+	go func() {
+		for off := 0; off < len(msg); off += 7000 {
+			end := off + 7000
+			if end > len(msg) {
+				end = len(msg)
+			}
+			if _, err := client.Write(msg[off:end]); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		_ = client.Close()
+	}()
+
+	got, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got %v bytes, sent %v", len(got), len(msg))
+	}
+}
+
+func TestObfsOverheadBudget(t *testing.T) {
+	a, b := net.Pipe()
+	oc := NewObfsConn(a, protocol.ObfuscationParams{
+		MaxPadding:  1 << 30,
+		MaxOverhead: 0.1,
+	})
+
+	const writes, size = 200, 1000
+	go func() {
+		msg := make([]byte, size)
+		for i := 0; i < writes; i++ {
+			if _, err := oc.Write(msg); err != nil {
+				t.Error(err)
+			}
+		}
+		_ = oc.Close()
+	}()
+
+	wire, err := io.Copy(ioutil.Discard, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, overhead := oc.Stats()
+	if data != writes*size {
+		t.Errorf("data %v, want %v", data, writes*size)
+	}
+	if uint64(wire) != data+overhead {
+		t.Errorf("%v bytes on the wire, stats say %v data and %v overhead", wire, data, overhead)
+	}
+
+	// Headers are always sent, padding only within the budget.
+	limit := 0.1*float64(data) + obfsBudgetBurst + obfsHeaderSize*writes
+	if float64(overhead) > limit {
+		t.Errorf("overhead %v exceeds the budget %v", overhead, limit)
+	}
+	if overhead <= obfsHeaderSize*writes {
+		t.Error("no padding sent")
+	}
+}
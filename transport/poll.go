@@ -0,0 +1,504 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The polling transport carries the tunnel in ordinary HTTP requests tied
+// together by a session id: POST requests upload client data, GET requests
+// are held by the server until it has something to send back. Both
+// directions are numbered, so a request repeated by a proxy is detected and
+// a lost download can be asked for again.
+const (
+	PollSessionParam = "sid"
+	PollSeqParam     = "n"
+
+	pollWait        = 20 * time.Second
+	pollIdleTimeout = 2 * time.Minute
+	pollMaxChunk    = 1 << 20
+	pollMaxBuffered = 4 << 20
+)
+
+var errPollClosed = errors.New("polling session closed")
+
+// IsPollRequest checks whether the request belongs to a polling session.
+func IsPollRequest(r *http.Request) bool {
+	return r.URL.Query().Get(PollSessionParam) != ""
+}
+
+// PollSessions keeps the server side of polling sessions.
+type PollSessions struct {
+	m        sync.Mutex
+	sessions map[string]*pollServerConn
+}
+
+func NewPollSessions() *PollSessions {
+	return &PollSessions{sessions: make(map[string]*pollServerConn)}
+}
+
+// Serve handles a request of a polling session. For a request opening a new
+// session, start is called in a new goroutine with the session connection.
+func (p *PollSessions) Serve(w http.ResponseWriter, r *http.Request, start func(net.Conn)) {
+	query := r.URL.Query()
+	id := query.Get(PollSessionParam)
+	seq, err := strconv.ParseUint(query.Get(PollSeqParam), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	// A session is opened by its first upload or first download.
+	isFirst := r.Method == "POST" && seq == 0 || r.Method == "GET" && seq == 1
+
+	p.m.Lock()
+	pc := p.sessions[id]
+	if pc == nil && isFirst {
+		pc = newPollServerConn()
+		p.sessions[id] = pc
+		go start(pc)
+		go p.expire(id, pc)
+	}
+	p.m.Unlock()
+
+	if pc == nil {
+		w.WriteHeader(410)
+		return
+	}
+
+	pc.touch()
+	switch r.Method {
+	case "POST":
+		pc.serveUpload(w, r, seq)
+	case "GET":
+		pc.serveDownload(w, r, seq)
+	case "DELETE":
+		_ = pc.Close()
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (p *PollSessions) expire(id string, pc *pollServerConn) {
+	for {
+		idle := pc.idle()
+		if pc.isClosed() || idle > pollIdleTimeout {
+			_ = pc.Close()
+			p.m.Lock()
+			delete(p.sessions, id)
+			p.m.Unlock()
+			return
+		}
+		time.Sleep(pollIdleTimeout - idle)
+	}
+}
+
+type pollServerConn struct {
+	m          sync.Mutex
+	spaceFreed *sync.Cond
+	dataReady  chan struct{}
+	down       bytes.Buffer
+	downSeq    uint64
+	lastChunk  []byte
+	upSeq      uint64
+	closed     bool
+	lastActive time.Time
+
+	upR *io.PipeReader
+	upW *io.PipeWriter
+}
+
+func newPollServerConn() *pollServerConn {
+	pc := &pollServerConn{dataReady: make(chan struct{}, 1), lastActive: time.Now()}
+	pc.spaceFreed = sync.NewCond(&pc.m)
+	pc.upR, pc.upW = io.Pipe()
+	return pc
+}
+
+func (pc *pollServerConn) serveUpload(w http.ResponseWriter, r *http.Request, seq uint64) {
+	// The body is read completely before being accepted, so an interrupted
+	// upload can be safely repeated.
+	chunk, err := ioutil.ReadAll(io.LimitReader(r.Body, pollMaxChunk+1))
+	if err != nil || len(chunk) > pollMaxChunk {
+		w.WriteHeader(400)
+		return
+	}
+
+	pc.m.Lock()
+	expected := pc.upSeq
+	if seq == expected {
+		pc.upSeq++
+	}
+	pc.m.Unlock()
+
+	switch {
+	case seq < expected:
+		// Repeated request, the data is already there.
+		w.WriteHeader(204)
+		return
+	case seq > expected:
+		w.WriteHeader(400)
+		return
+	}
+
+	if _, err := pc.upW.Write(chunk); err != nil {
+		w.WriteHeader(410)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (pc *pollServerConn) serveDownload(w http.ResponseWriter, r *http.Request, seq uint64) {
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+
+	timedOut := false
+	pc.m.Lock()
+	for pc.downSeq+1 == seq && pc.down.Len() == 0 && !pc.closed && !timedOut {
+		pc.m.Unlock()
+		select {
+		case <-pc.dataReady:
+		case <-timer.C:
+			timedOut = true
+		case <-r.Context().Done():
+			return
+		}
+		pc.m.Lock()
+	}
+
+	switch {
+	case seq == pc.downSeq:
+		// The previous response got lost, repeat it.
+		chunk := pc.lastChunk
+		pc.m.Unlock()
+		writeChunk(w, chunk)
+		return
+
+	case seq != pc.downSeq+1:
+		pc.m.Unlock()
+		w.WriteHeader(400)
+		return
+
+	case pc.closed && pc.down.Len() == 0:
+		pc.m.Unlock()
+		w.WriteHeader(410)
+		return
+	}
+
+	n := pc.down.Len()
+	if n > pollMaxChunk {
+		n = pollMaxChunk
+	}
+	chunk := make([]byte, n)
+	_, _ = pc.down.Read(chunk)
+	pc.downSeq = seq
+	pc.lastChunk = chunk
+	pc.spaceFreed.Broadcast()
+	pc.m.Unlock()
+
+	writeChunk(w, chunk)
+}
+
+func writeChunk(w http.ResponseWriter, chunk []byte) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(chunk)))
+	w.WriteHeader(200)
+	_, _ = w.Write(chunk)
+}
+
+func (pc *pollServerConn) Read(b []byte) (int, error) {
+	return pc.upR.Read(b)
+}
+
+func (pc *pollServerConn) Write(b []byte) (int, error) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	for pc.down.Len() > pollMaxBuffered && !pc.closed {
+		pc.spaceFreed.Wait()
+	}
+
+	if pc.closed {
+		return 0, errPollClosed
+	}
+
+	pc.down.Write(b)
+	select {
+	case pc.dataReady <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (pc *pollServerConn) Close() error {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	if !pc.closed {
+		pc.closed = true
+		pc.spaceFreed.Broadcast()
+		select {
+		case pc.dataReady <- struct{}{}:
+		default:
+		}
+		_ = pc.upW.Close()
+		_ = pc.upR.Close()
+	}
+	return nil
+}
+
+func (pc *pollServerConn) touch() {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	pc.lastActive = time.Now()
+}
+
+func (pc *pollServerConn) idle() time.Duration {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	return time.Since(pc.lastActive)
+}
+
+func (pc *pollServerConn) isClosed() bool {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	return pc.closed
+}
+
+func (pc *pollServerConn) LocalAddr() net.Addr                { return dummyAddr{} }
+func (pc *pollServerConn) RemoteAddr() net.Addr               { return dummyAddr{} }
+func (pc *pollServerConn) SetDeadline(t time.Time) error      { return nil }
+func (pc *pollServerConn) SetReadDeadline(t time.Time) error  { return nil }
+func (pc *pollServerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// PollClientConn is the client side of a polling session.
+type PollClientConn struct {
+	client *http.Client
+	url    *url.URL
+	header func() http.Header
+	id     string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	m        sync.Mutex
+	cond     *sync.Cond
+	up       bytes.Buffer
+	closed   bool
+	closeErr error
+
+	downR *io.PipeReader
+	downW *io.PipeWriter
+}
+
+// NewPollClientConn starts a polling session at address. The header is made
+// anew for every request, so it may carry single-use credentials.
+func NewPollClientConn(client *http.Client, address string, header func() http.Header) (*PollClientConn, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := &PollClientConn{
+		client: client,
+		url:    parsed,
+		header: header,
+		id:     hex.EncodeToString(id[:]),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	pc.cond = sync.NewCond(&pc.m)
+	pc.downR, pc.downW = io.Pipe()
+
+	go pc.uploadLoop()
+	go pc.downloadLoop()
+	return pc, nil
+}
+
+func (pc *PollClientConn) Read(b []byte) (int, error) {
+	return pc.downR.Read(b)
+}
+
+func (pc *PollClientConn) Write(b []byte) (int, error) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	for pc.up.Len() > pollMaxBuffered && !pc.closed {
+		pc.cond.Wait()
+	}
+
+	if pc.closed {
+		return 0, pc.closeErr
+	}
+
+	pc.up.Write(b)
+	pc.cond.Broadcast()
+	return len(b), nil
+}
+
+func (pc *PollClientConn) Close() error {
+	if pc.closeWithError(errPollClosed) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), pollWait)
+			defer cancel()
+			if resp, err := pc.do(ctx, "DELETE", 0, nil); err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+	}
+	return nil
+}
+
+func (pc *PollClientConn) closeWithError(err error) bool {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	if pc.closed {
+		return false
+	}
+
+	pc.closed = true
+	pc.closeErr = err
+	pc.cond.Broadcast()
+	pc.cancel()
+	_ = pc.downW.CloseWithError(err)
+	return true
+}
+
+func (pc *PollClientConn) uploadLoop() {
+	for seq := uint64(0); ; seq++ {
+		pc.m.Lock()
+		for pc.up.Len() == 0 && !pc.closed {
+			pc.cond.Wait()
+		}
+
+		if pc.closed {
+			pc.m.Unlock()
+			return
+		}
+
+		n := pc.up.Len()
+		if n > pollMaxChunk {
+			n = pollMaxChunk
+		}
+		chunk := make([]byte, n)
+		_, _ = pc.up.Read(chunk)
+		pc.cond.Broadcast()
+		pc.m.Unlock()
+
+		if err := pc.upload(seq, chunk); err != nil {
+			pc.closeWithError(err)
+			return
+		}
+	}
+}
+
+// upload sends the chunk, retrying once if the request fails: the server
+// recognizes the repeated sequence number.
+func (pc *PollClientConn) upload(seq uint64, chunk []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var resp *http.Response
+		resp, err = pc.do(pc.ctx, "POST", seq, chunk)
+		if err != nil {
+			continue
+		}
+
+		_ = resp.Body.Close()
+		if resp.StatusCode != 204 {
+			return fmt.Errorf("upload failed: %v", resp.Status)
+		}
+		return nil
+	}
+	return err
+}
+
+func (pc *PollClientConn) downloadLoop() {
+	for seq := uint64(0); ; {
+		chunk, err := pc.download(seq + 1)
+		if err != nil {
+			// Ask for the same chunk once more, the server keeps it.
+			chunk, err = pc.download(seq + 1)
+		}
+
+		if err != nil {
+			pc.closeWithError(err)
+			return
+		}
+
+		seq++
+		if len(chunk) == 0 {
+			continue
+		}
+
+		if _, err := pc.downW.Write(chunk); err != nil {
+			return
+		}
+	}
+}
+
+func (pc *PollClientConn) download(seq uint64) ([]byte, error) {
+	resp, err := pc.do(pc.ctx, "GET", seq, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == 410 {
+		return nil, io.EOF
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("download failed: %v", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (pc *PollClientConn) do(ctx context.Context, method string, seq uint64, body []byte) (*http.Response, error) {
+	u := *pc.url
+	query := u.Query()
+	query.Set(PollSessionParam, pc.id)
+	query.Set(PollSeqParam, strconv.FormatUint(seq, 10))
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range pc.header() {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	return pc.client.Do(req.WithContext(ctx))
+}
+
+func (pc *PollClientConn) LocalAddr() net.Addr                { return dummyAddr{} }
+func (pc *PollClientConn) RemoteAddr() net.Addr               { return dummyAddr{} }
+func (pc *PollClientConn) SetDeadline(t time.Time) error      { return nil }
+func (pc *PollClientConn) SetReadDeadline(t time.Time) error  { return nil }
+func (pc *PollClientConn) SetWriteDeadline(t time.Time) error { return nil }
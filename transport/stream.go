@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrStreamClosed = errors.New("stream closed")
+
+// StreamConn turns a pair of streams (e.g. bodies of a full-duplex HTTP/2
+// request and response) into a net.Conn. Deadlines are not supported and
+// silently ignored. Addresses are taken from base, which may be nil.
+type StreamConn struct {
+	r io.ReadCloser
+	w io.Writer
+
+	// wm is the write lock, a channel so that neither Close nor the writes
+	// queued behind it wait for a Write stuck on a stalled stream.
+	wm   chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+	onClose   func()
+	base      net.Conn
+}
+
+func NewStreamConn(r io.ReadCloser, w io.Writer, base net.Conn, onClose func()) *StreamConn {
+	return &StreamConn{
+		r:       r,
+		w:       w,
+		wm:      make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		base:    base,
+		onClose: onClose,
+	}
+}
+
+func (c *StreamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *StreamConn) Write(b []byte) (int, error) {
+	select {
+	case c.wm <- struct{}{}:
+	case <-c.done:
+		return 0, ErrStreamClosed
+	}
+	defer func() { <-c.wm }()
+
+	select {
+	case <-c.done:
+		return 0, ErrStreamClosed
+	default:
+	}
+	return c.w.Write(b)
+}
+
+// Close doesn't wait for the write in progress (if any), which is left to
+// fail once the underlying streams are closed. No new writes start after
+// Close returns.
+func (c *StreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.r.Close()
+		if wc, ok := c.w.(io.Closer); ok {
+			_ = wc.Close()
+		}
+
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	if c.base == nil {
+		return dummyAddr{}
+	}
+	return c.base.LocalAddr()
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	if c.base == nil {
+		return dummyAddr{}
+	}
+	return c.base.RemoteAddr()
+}
+
+func (c *StreamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *StreamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *StreamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "stream" }
+func (dummyAddr) String() string  { return "stream" }
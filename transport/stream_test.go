@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stalledWriter blocks every Write until released, like the response of an
+// HTTP/2 stream the peer doesn't read.
+type stalledWriter struct {
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return len(b), nil
+}
+
+func TestStreamCloseWithBlockedWrite(t *testing.T) {
+	w := &stalledWriter{release: make(chan struct{})}
+	defer close(w.release)
+	conn := NewStreamConn(ioutil.NopCloser(strings.NewReader("")), w, nil, nil)
+
+	go func() { _, _ = conn.Write([]byte("stuck")) }()
+	time.Sleep(50 * time.Millisecond)
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("queued"))
+		queued <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs while a Write is blocked")
+	}
+
+	select {
+	case err := <-queued:
+		if err != ErrStreamClosed {
+			t.Errorf("queued Write error %v, want %v", err, ErrStreamClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued Write hangs after Close")
+	}
+
+	if _, err := conn.Write([]byte("late")); err != ErrStreamClosed {
+		t.Errorf("Write after Close error %v, want %v", err, ErrStreamClosed)
+	}
+}
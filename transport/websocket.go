@@ -0,0 +1,284 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketCloseTimeout limits the time spent sending the close frame, the
+// connection is closed anyway.
+const webSocketCloseTimeout = time.Second
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// WebSocketConn carries a byte stream in RFC 6455 binary frames. Each Write
+// is sent as a single frame, Read returns payload of data frames and handles
+// control frames transparently.
+type WebSocketConn struct {
+	r        io.Reader
+	isClient bool
+
+	// wm is the write lock, a channel so that Close can skip the close frame
+	// instead of waiting for a Write stuck on a stalled connection.
+	wm chan struct{}
+
+	rm        sync.Mutex
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	closeOnce sync.Once
+
+	net.Conn
+}
+
+// NewWebSocketConn wraps conn whose handshake is already done. Data is read
+// from r (which may hold bytes buffered during the handshake) or from conn
+// if r is nil.
+func NewWebSocketConn(conn net.Conn, r io.Reader, isClient bool) *WebSocketConn {
+	if r == nil {
+		r = conn
+	}
+	return &WebSocketConn{r: r, isClient: isClient, wm: make(chan struct{}, 1), Conn: conn}
+}
+
+func NewWebSocketKey() string {
+	var key [16]byte
+	_, _ = rand.Read(key[:])
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func WebSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// IsWebSocketRequest checks whether the request asks for a websocket upgrade.
+func IsWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerContains(r.Header, "Connection", "upgrade")
+}
+
+// CheckWebSocketResponse validates the server handshake response.
+func CheckWebSocketResponse(resp *http.Response, key string) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("websocket handshake failed: %v", resp.Status)
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != WebSocketAccept(key) {
+		return errors.New("websocket handshake failed: invalid response headers")
+	}
+
+	return nil
+}
+
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+
+	for c.remaining == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *WebSocketConn) Close() error {
+	c.sendClose(nil)
+	return c.Conn.Close()
+}
+
+// sendClose sends the close frame once. It is skipped if a write is in
+// progress, and given webSocketCloseTimeout otherwise.
+func (c *WebSocketConn) sendClose(payload []byte) {
+	c.closeOnce.Do(func() {
+		select {
+		case c.wm <- struct{}{}:
+		default:
+			return
+		}
+		defer func() { <-c.wm }()
+
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(webSocketCloseTimeout))
+		_, _ = c.Conn.Write(c.frame(opClose, payload))
+	})
+}
+
+// readHeader reads frame headers until a data frame starts. Control frames
+// are handled on the way.
+func (c *WebSocketConn) readHeader() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+
+	opcode := hdr[0] & 0x0f
+	c.masked = hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7f)
+
+	// Clients must mask their frames and servers must not (RFC 6455 5.1).
+	if c.masked == c.isClient {
+		if c.isClient {
+			return errors.New("masked websocket frame from server")
+		}
+		return errors.New("unmasked websocket frame from client")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	c.maskPos = 0
+	if c.masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errors.New("websocket control frame too long")
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+
+		switch opcode {
+		case opClose:
+			c.sendClose(payload)
+			return io.EOF
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown websocket opcode %v", opcode)
+	}
+}
+
+func (c *WebSocketConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := c.frame(opcode, payload)
+
+	c.wm <- struct{}{}
+	defer func() { <-c.wm }()
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *WebSocketConn) frame(opcode byte, payload []byte) []byte {
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | opcode
+
+	l := len(payload)
+	switch {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+	default:
+		hdr[1] = 127
+		hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+	}
+
+	frame := payload
+	if c.isClient {
+		// Clients must mask every frame they send.
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask[:]...)
+
+		frame = make([]byte, l)
+		for i := range payload {
+			frame[i] = payload[i] ^ mask[i&3]
+		}
+	}
+
+	return append(hdr, frame...)
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewWebSocketConn(a, nil, true)
+	server := NewWebSocketConn(b, nil, false)
+	defer func() { _ = client.Close(); _ = server.Close() }()
+
+	for _, size := range []int{0, 1, 125, 126, 65535, 65536, 100000} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		for _, dir := range []struct{ from, to *WebSocketConn }{{client, server}, {server, client}} {
+			go func(from *WebSocketConn) { _, _ = from.Write(msg) }(dir.from)
+
+			if size == 0 {
+				// Empty frames carry no data, so there's nothing to read.
+				continue
+			}
+
+			got := make([]byte, size)
+			if _, err := io.ReadFull(dir.to, got); err != nil {
+				t.Fatalf("size %v: %v", size, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("size %v: data mismatch", size)
+			}
+		}
+	}
+}
+
+func TestWebSocketMasking(t *testing.T) {
+	tests := []struct {
+		isClient bool
+		frame    []byte
+		err      string
+	}{
+		{false, []byte{0x82, 0x01, 'x'}, "unmasked websocket frame from client"},
+		{true, []byte{0x82, 0x81, 1, 2, 3, 4, 'x' ^ 1}, "masked websocket frame from server"},
+	}
+
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		conn := NewWebSocketConn(a, nil, tt.isClient)
+		go func() { _, _ = b.Write(tt.frame) }()
+
+		_, err := conn.Read(make([]byte, 10))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("client %v: error %v, want %v", tt.isClient, err, tt.err)
+		}
+		_ = a.Close()
+		_ = b.Close()
+	}
+}
+
+func TestWebSocketCloseWithBlockedWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer func() { _ = b.Close() }()
+	conn := NewWebSocketConn(a, nil, true)
+
+	// Nobody reads b, so the write is stuck.
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("stuck"))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs while a Write is blocked")
+	}
+
+	if err := <-written; err == nil {
+		t.Error("blocked Write succeeded after Close")
+	}
+}
+
+func TestWebSocketCloseFrameTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer func() { _ = b.Close() }()
+	conn := NewWebSocketConn(a, nil, false)
+
+	start := time.Now()
+	_ = conn.Close()
+	if d := time.Since(start); d > webSocketCloseTimeout+time.Second {
+		t.Errorf("Close took %v with a peer not reading", d)
+	}
+}